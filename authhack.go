@@ -2,8 +2,21 @@ package traefik_authhack
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
+	"io"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 /*
@@ -14,17 +27,192 @@ TODO:
 
 const AuthorizationHeader = "Authorization"
 
+// SourceHeader and UserHeader are set on the request when AccessLogHeaders is enabled so that they can be captured by
+// Traefik's access log (see `accessLog.fields.headers`).
+const SourceHeader = "X-AuthHack-Source"
+const UserHeader = "X-AuthHack-User"
+
+// PHPAuthUserHeader and PHPAuthPwHeader are set on the request when EmitPHPAuthHeaders is enabled so that a FastCGI
+// bridge can map them to `PHP_AUTH_USER` / `PHP_AUTH_PW`.
+const PHPAuthUserHeader = "X-Php-Auth-User"
+const PHPAuthPwHeader = "X-Php-Auth-Pw"
+
+// MissingPasswordAllow and MissingPasswordSkip are the supported values of Config.MissingPasswordPolicy.
+const (
+	MissingPasswordAllow = "allow"
+	MissingPasswordSkip  = "skip"
+)
+
+const (
+	sourceQuery  = "query"
+	sourceCookie = "cookie"
+)
+
+const (
+	decisionNoop       = "noop"
+	decisionRedirected = "redirected"
+	decisionApplied    = "applied:"
+	decisionRejected   = "rejected"
+)
+
+// grpcMetadataAuthorizationHeader is mapped to the `authorization` metadata by gRPC gateways.
+const grpcMetadataAuthorizationHeader = "Grpc-Metadata-Authorization"
+
+// queryCredentialsWarning is the value of Config.QueryCredentialsWarningHeader.
+const queryCredentialsWarning = "credentials in query params are deprecated, use the authorization header or cookie instead"
+
+// forwardedURIHeaders are headers set by proxies that contain the original URI of the request, including its query.
+var forwardedURIHeaders = []string{"X-Forwarded-Uri", "X-Original-Url"}
+
+// arraySyntaxSuffix is appended to query param names by some frameworks (e.g. `username[]=value`).
+const arraySyntaxSuffix = "[]"
+
+// credentialLikeQueryParamPatterns are matched (case-insensitively) against query param names when
+// RejectUnknownCredentialParams is enabled.
+var credentialLikeQueryParamPatterns = []string{"pass", "pwd", "token", "secret"}
+
 // Config is the configuration for the plugin.
 type Config struct {
 	LogLevel LogLevel `json:",omitempty"`
 
+	HeaderName string `json:",omitempty"`
+
 	UsernameQueryParam      string `json:",omitempty"`
 	PasswordQueryParam      string `json:",omitempty"`
 	AuthorizationQueryParam string `json:",omitempty"`
 
+	PathKeyOverrides map[string]*PathKeyOverride `json:",omitempty"`
+
+	StrictPlusDecoding  bool `json:",omitempty"`
+	AllowArraySyntax    bool `json:",omitempty"`
+	CaseInsensitiveKeys bool `json:",omitempty"`
+
+	CredentialCharset string `json:",omitempty"`
+
+	StrictCredentials    bool `json:",omitempty"`
+	ValidateJWTStructure bool `json:",omitempty"`
+
+	MinUsernameLength        int    `json:",omitempty"`
+	MaxUsernameLength        int    `json:",omitempty"`
+	MaxPasswordLength        int    `json:",omitempty"`
+	AllowedCharactersPattern string `json:",omitempty"`
+
+	FallbackUsername      string `json:",omitempty"`
+	AllowEmptyUsername    bool   `json:",omitempty"`
+	MissingPasswordPolicy string `json:",omitempty"`
+
+	AutoSplitUsernameColon bool `json:",omitempty"`
+
+	ReadURLUserInfo   bool `json:",omitempty"`
+	PreferURLUserInfo bool `json:",omitempty"`
+
+	NestedCredentialKey     string   `json:",omitempty"`
+	NestedCredentialSchemes []string `json:",omitempty"`
+
+	ProxyQueryParam        string `json:",omitempty"`
+	RewriteProxyQueryParam bool   `json:",omitempty"`
+
+	CredentialsKeys []string `json:",omitempty"`
+
+	DoubleDecodeAuthorization  bool     `json:",omitempty"`
+	AuthorizationFromHeaderKey bool     `json:",omitempty"`
+	AllowedReferencedHeaders   []string `json:",omitempty"`
+	BearerMarkers              []string `json:",omitempty"`
+
+	CSRFKey        string `json:",omitempty"`
+	CSRFHeaderName string `json:",omitempty"`
+
 	CookieName   string `json:",omitempty"`
 	CookieDomain string `json:",omitempty"`
 	CookiePath   string `json:",omitempty"`
+
+	CookieOnGetOnly bool `json:",omitempty"`
+
+	RedirectAllowedPrefixes []string `json:",omitempty"`
+
+	StripOwnCookie bool `json:",omitempty"`
+
+	CredentialQueryCookie string `json:",omitempty"`
+
+	CookieEncryptionKey         string `json:",omitempty"`
+	CookieEncryptionKeyPrevious string `json:",omitempty"`
+
+	CookieSigningKey             string `json:",omitempty"`
+	CookieSignatureMaxAgeSeconds int    `json:",omitempty"`
+	ResignCookieOnUse            bool   `json:",omitempty"`
+
+	RejectOnCookieCryptoError bool `json:",omitempty"`
+
+	ForbidQueryCredentialsAfterCookie bool `json:",omitempty"`
+
+	WarnOnQueryCredentials        bool   `json:",omitempty"`
+	QueryCredentialsWarningHeader string `json:",omitempty"`
+
+	SingleUseCredentials bool `json:",omitempty"`
+	SingleUseCacheSize   int  `json:",omitempty"`
+	SingleUseTTLSeconds  int  `json:",omitempty"`
+
+	ScrubForwardedURI bool `json:",omitempty"`
+
+	AccessLogHeaders bool `json:",omitempty"`
+
+	EmitPHPAuthHeaders bool `json:",omitempty"`
+
+	TrustedCIDRs      []string `json:",omitempty"`
+	TrustedProxyCIDRs []string `json:",omitempty"`
+
+	SkipConditionalRequests bool `json:",omitempty"`
+
+	StripOnPreflight bool `json:",omitempty"`
+
+	GRPCWebQueryCredentials bool `json:",omitempty"`
+	GRPCWebMetadataHeader   bool `json:",omitempty"`
+
+	NormalizeIncomingScheme bool `json:",omitempty"`
+	CollapseMultiAuth       bool `json:",omitempty"`
+
+	RejectUnknownCredentialParams bool     `json:",omitempty"`
+	KnownSafeQueryParams          []string `json:",omitempty"`
+
+	RejectJitterMinMs int `json:",omitempty"`
+	RejectJitterMaxMs int `json:",omitempty"`
+
+	ChallengeSchemes []string `json:",omitempty"`
+	ChallengeRealm   string   `json:",omitempty"`
+
+	DecisionResponseHeader string `json:",omitempty"`
+
+	DecisionHistorySize int    `json:",omitempty"`
+	DebugToken          string `json:",omitempty"`
+
+	NoStoreOnAuth bool `json:",omitempty"`
+
+	SetReferrerPolicy bool `json:",omitempty"`
+
+	CleanupIntervalSeconds int `json:",omitempty"`
+
+	LogForwardedURL bool `json:",omitempty"`
+
+	BasePath        string `json:",omitempty"`
+	HealthEndpoint  bool   `json:",omitempty"`
+	MetricsEndpoint bool   `json:",omitempty"`
+
+	LogoutEndpoint     bool   `json:",omitempty"`
+	LogoutRequireToken bool   `json:",omitempty"`
+	LogoutToken        string `json:",omitempty"`
+
+	PreAuthURL       string `json:",omitempty"`
+	PreAuthTimeoutMs int    `json:",omitempty"`
+
+	MaxConfigListEntries int `json:",omitempty"`
+}
+
+// PathKeyOverride overrides the credential query param names for requests under a path, empty names use the base
+// config's.
+type PathKeyOverride struct {
+	UsernameQueryParam      string `json:",omitempty"`
+	PasswordQueryParam      string `json:",omitempty"`
+	AuthorizationQueryParam string `json:",omitempty"`
 }
 
 // CreateConfig creates the default plugin configuration.
@@ -32,20 +220,150 @@ func CreateConfig() *Config {
 	return &Config{
 		LogLevel: Warning,
 
+		HeaderName: AuthorizationHeader,
+
 		UsernameQueryParam:      "username",
 		PasswordQueryParam:      "password",
 		AuthorizationQueryParam: "authorization",
 
+		PathKeyOverrides: nil,
+
+		StrictPlusDecoding: true,
+		AllowArraySyntax:   false,
+
+		CaseInsensitiveKeys: false,
+
+		CredentialCharset: CharsetUTF8,
+
+		StrictCredentials:    false,
+		ValidateJWTStructure: false,
+
+		MinUsernameLength:        0,
+		MaxUsernameLength:        0,
+		MaxPasswordLength:        0,
+		AllowedCharactersPattern: "",
+
+		FallbackUsername:      "",
+		AllowEmptyUsername:    false,
+		MissingPasswordPolicy: MissingPasswordAllow,
+
+		AutoSplitUsernameColon: false,
+
+		ReadURLUserInfo:   false,
+		PreferURLUserInfo: false,
+
+		NestedCredentialKey:     "",
+		NestedCredentialSchemes: nil,
+
+		ProxyQueryParam:        "",
+		RewriteProxyQueryParam: false,
+
+		CredentialsKeys: nil,
+
+		DoubleDecodeAuthorization:  false,
+		AuthorizationFromHeaderKey: false,
+		AllowedReferencedHeaders:   nil,
+		BearerMarkers:              nil,
+
+		CSRFKey:        "",
+		CSRFHeaderName: "X-CSRF-Token",
+
 		CookieName:   "traefik-authhack",
 		CookieDomain: "",
 		CookiePath:   "/",
+
+		CookieOnGetOnly: true,
+
+		RedirectAllowedPrefixes: nil,
+
+		StripOwnCookie: true,
+
+		CredentialQueryCookie: "",
+
+		CookieEncryptionKey:         "",
+		CookieEncryptionKeyPrevious: "",
+
+		CookieSigningKey:             "",
+		CookieSignatureMaxAgeSeconds: 0,
+		ResignCookieOnUse:            false,
+
+		RejectOnCookieCryptoError: false,
+
+		ForbidQueryCredentialsAfterCookie: false,
+
+		WarnOnQueryCredentials:        false,
+		QueryCredentialsWarningHeader: "",
+
+		SingleUseCredentials: false,
+		SingleUseCacheSize:   10000,
+		SingleUseTTLSeconds:  86400,
+
+		ScrubForwardedURI: false,
+
+		AccessLogHeaders: false,
+
+		EmitPHPAuthHeaders: false,
+
+		TrustedCIDRs:      nil,
+		TrustedProxyCIDRs: nil,
+
+		SkipConditionalRequests: false,
+
+		StripOnPreflight: false,
+
+		GRPCWebQueryCredentials: false,
+		GRPCWebMetadataHeader:   false,
+
+		NormalizeIncomingScheme: false,
+		CollapseMultiAuth:       false,
+
+		RejectUnknownCredentialParams: false,
+		KnownSafeQueryParams:          nil,
+
+		RejectJitterMinMs: 0,
+		RejectJitterMaxMs: 0,
+
+		ChallengeSchemes: nil,
+		ChallengeRealm:   "",
+
+		DecisionResponseHeader: "",
+
+		DecisionHistorySize: 0,
+		DebugToken:          "",
+
+		NoStoreOnAuth: true,
+
+		SetReferrerPolicy: false,
+
+		CleanupIntervalSeconds: 0,
+
+		LogForwardedURL: false,
+
+		BasePath:        "/_authhack",
+		HealthEndpoint:  false,
+		MetricsEndpoint: false,
+
+		LogoutEndpoint:     false,
+		LogoutRequireToken: false,
+		LogoutToken:        "",
+
+		PreAuthURL:       "",
+		PreAuthTimeoutMs: 5000,
+
+		MaxConfigListEntries: 256,
 	}
 }
 
+// logWriter is where logs are written, Traefik captures the plugin's stdout.
+var logWriter io.Writer = os.Stdout
+
 func (c *Config) log(level LogLevel, name, format string, args ...any) {
-	if level <= c.LogLevel {
-		fmt.Printf("%s (%s): %s: %s\n", "AuthHack", name, level.String(), fmt.Sprintf(format, args...))
+	// None silences everything, including startup logs
+	if c.LogLevel <= None || level > c.LogLevel {
+		return
 	}
+
+	_, _ = fmt.Fprintf(logWriter, "%s (%s): %s: %s\n", "AuthHack", name, level.String(), fmt.Sprintf(format, args...))
 }
 
 // AuthHackPlugin is the plugin.
@@ -53,6 +371,44 @@ type AuthHackPlugin struct {
 	next   http.Handler
 	config *Config
 	name   string
+
+	trustedNetworks []*net.IPNet
+	trustedProxies  []*net.IPNet
+
+	// Matches the whole username / password, nil if disabled
+	allowedCharacters *regexp.Regexp
+
+	// Hashes of the query param credentials that have already been used, nil if disabled
+	usedCredentials *ttlCache
+
+	// Encrypts the cookie value, nil if disabled
+	cookieCipher *cookieCipher
+
+	// Signs the (encrypted) cookie value, nil if disabled
+	cookieSigner *cookieSigner
+
+	// The most recent decisions, nil if disabled
+	decisionHistory *decisionHistory
+
+	// Counts what the plugin does with requests, nil if disabled
+	metrics *metrics
+
+	// Client used to send pre-auth requests, nil if disabled
+	preAuthClient *http.Client
+
+	// Evicts expired entries from the caches in the background, nil if disabled (or there's nothing to clean up)
+	cleanup *cleanup
+
+	// Maps the full path of each enabled endpoint (under the base path) to its handler
+	endpoints map[string]http.HandlerFunc
+
+	// Plugins for the path key overrides (sharing this plugin's state), longest path first
+	pathOverrides []pathOverride
+}
+
+type pathOverride struct {
+	path   string // Without a trailing slash
+	plugin *AuthHackPlugin
 }
 
 // New creates a new plugin.
@@ -61,163 +417,1488 @@ type AuthHackPlugin struct {
 func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
 	config.log(Info, name, "initializing")
 
-	return &AuthHackPlugin{
-		config: config,
-		next:   next,
-		name:   name,
-	}, nil
-}
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
 
-func (p *AuthHackPlugin) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
-	p.log(Debug, "serving request '%s' ('%s')", request.URL, request.RequestURI)
+	trustedNetworks, err := parseCIDRs(config.TrustedCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TrustedCIDRs: %w", err)
+	}
 
-	hasAuthHeader := p.hasAuthHeader(request)
+	trustedProxies, err := parseCIDRs(config.TrustedProxyCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TrustedProxyCIDRs: %w", err)
+	}
 
-	// Even if we have an auth header, invoke the other handlers so they can scrub the request
-	queryParamsAuthWithoutPrefix := p.getAndScrubAuthQueryParams(request)
-	cookieAuthWithoutPrefix := p.getAndScrubAuthCookie(request)
+	var allowedCharacters *regexp.Regexp
+	if config.AllowedCharactersPattern != "" {
+		allowedCharacters, err = regexp.Compile("^(?:" + config.AllowedCharactersPattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid AllowedCharactersPattern: %w", err)
+		}
+	}
 
-	if hasAuthHeader {
-		// The request already has an auth header, prefer using that before anything from this plugin
+	cookieCipher, err := newCookieCipher(config.CookieEncryptionKey, config.CookieEncryptionKeyPrevious)
+	if err != nil {
+		return nil, err
+	}
 
-		p.log(Debug, "found authorization header, proxying request")
+	preAuthClient, err := newPreAuthClient(config)
+	if err != nil {
+		return nil, err
+	}
 
-		p.next.ServeHTTP(responseWriter, request)
+	plugin := &AuthHackPlugin{
+		config: config,
+		next:   next,
+		name:   name,
 
-		return
+		trustedNetworks:   trustedNetworks,
+		trustedProxies:    trustedProxies,
+		allowedCharacters: allowedCharacters,
+		cookieCipher:      cookieCipher,
+		cookieSigner:      newCookieSigner(config.CookieSigningKey, time.Duration(config.CookieSignatureMaxAgeSeconds)*time.Second),
+		preAuthClient:     preAuthClient,
 	}
 
-	if !queryParamsAuthWithoutPrefix.IsEmpty() && queryParamsAuthWithoutPrefix != cookieAuthWithoutPrefix {
-		// The request had auth specified by the query params that differs from the cookie (or the cookie isn't set),
-		// request that the client sets an auth cookie for subsequent requests and redirect them to the URL without
-		// query params set.
+	if config.SingleUseCredentials {
+		plugin.usedCredentials = newTTLCache(config.SingleUseCacheSize, time.Duration(config.SingleUseTTLSeconds)*time.Second)
+	}
 
-		p.log(Debug, "cookie is unset or differs from provided auth, requesting redirect and set cookie")
+	if config.DecisionHistorySize > 0 {
+		plugin.decisionHistory = newDecisionHistory(config.DecisionHistorySize)
+	}
 
-		// Set the cookie
-		cookie := &http.Cookie{
-			Name:     p.config.CookieName,
-			Value:    queryParamsAuthWithoutPrefix.String(),
-			Domain:   p.config.CookieDomain,
-			Path:     p.config.CookiePath,
-			Secure:   true, // HTTPS only
-			HttpOnly: true, // Unavailable to JavaScript
-			SameSite: http.SameSiteStrictMode,
+	if config.MetricsEndpoint {
+		plugin.metrics = newMetrics()
+	}
+
+	if config.CleanupIntervalSeconds > 0 {
+		if caches := plugin.caches(); len(caches) > 0 {
+			plugin.cleanup = startCleanup(time.Duration(config.CleanupIntervalSeconds)*time.Second, caches...)
 		}
-		responseWriter.Header().Set("Set-Cookie", cookie.String())
+	}
 
-		// Request a redirect. HTTP 307 (Temporary Redirect) preserves the method and body.
-		responseWriter.Header().Set("Location", request.RequestURI)
-		responseWriter.WriteHeader(307)
+	plugin.endpoints = plugin.buildEndpoints()
+	plugin.pathOverrides = plugin.buildPathOverrides()
 
-		_, err := responseWriter.Write(nil)
-		if err != nil {
-			p.log(Warning, "encountered error sending redirect response: %v", err)
-		}
+	config.log(Info, name, "extraction priority: %s", strings.Join(plugin.extractionSources(), ", "))
 
-		return
+	return plugin, nil
+}
+
+// AuthHackPlugin implements io.Closer so that standalone users can release its resources.
+var _ io.Closer = (*AuthHackPlugin)(nil)
+
+// caches returns the enabled caches with expiring entries.
+func (p *AuthHackPlugin) caches() []*ttlCache {
+	var caches []*ttlCache
+	if p.usedCredentials != nil {
+		caches = append(caches, p.usedCredentials)
 	}
 
-	if !cookieAuthWithoutPrefix.IsEmpty() {
-		// Add auth from the cookie before finally sending the request downstream
+	return caches
+}
 
-		p.log(Debug, "found cookie, moving to authorization header and proxying request")
+// Close releases the plugin's resources by stopping the background cleanup (see CleanupIntervalSeconds) and closing
+// the idle pre-auth connections. Traefik doesn't call this, but standalone users should once they're done with the
+// plugin. It's safe to call more than once.
+func (p *AuthHackPlugin) Close() error {
+	if p.cleanup != nil {
+		p.cleanup.Stop()
+	}
 
-		request.Header.Add(AuthorizationHeader, cookieAuthWithoutPrefix.WithPrefix().String())
+	if p.preAuthClient != nil {
+		p.preAuthClient.CloseIdleConnections()
 	}
 
-	p.next.ServeHTTP(responseWriter, request)
+	return nil
 }
 
-func (p *AuthHackPlugin) log(level LogLevel, format string, args ...any) {
-	p.config.log(level, p.name, format, args...)
-}
+func (p *AuthHackPlugin) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	response := newResponseHeaderWrapper(responseWriter)
 
-func (p *AuthHackPlugin) hasAuthHeader(request *http.Request) bool {
-	return request.Header.Get(AuthorizationHeader) != ""
+	// In case the downstream handler doesn't write the response
+	defer response.Apply()
+
+	p.pathOverridePlugin(request.URL.Path).serveHTTP(response, request)
 }
 
-func (p *AuthHackPlugin) getAndScrubAuthQueryParams(request *http.Request) encodedAuthWithoutPrefix {
-	query := newQueryWrapper(request)
+// buildPathOverrides creates a plugin for each path key override, with the override merged into a copy of the config.
+// Everything else is shallow copied so that the state (e.g. caches) is shared.
+func (p *AuthHackPlugin) buildPathOverrides() []pathOverride {
+	var overrides []pathOverride
 
-	result := p.getAndScrubAuthQueryParam(query)
+	for path, override := range p.config.PathKeyOverrides {
+		config := *p.config
+		config.PathKeyOverrides = nil
 
-	// Even if we already have a result, continue to run the remaining handlers so they all get a chance to sanitize the request
-	userAndPassResult := p.getAndScrubUserPassQueryParams(query)
-	if result.IsEmpty() {
-		result = userAndPassResult
-	} else if result != userAndPassResult {
-		p.log(Info, "found both authorization query param and username / password query params that are mismatched, using authorization query param")
+		if override.UsernameQueryParam != "" {
+			config.UsernameQueryParam = override.UsernameQueryParam
+		}
+		if override.PasswordQueryParam != "" {
+			config.PasswordQueryParam = override.PasswordQueryParam
+		}
+		if override.AuthorizationQueryParam != "" {
+			config.AuthorizationQueryParam = override.AuthorizationQueryParam
+		}
+
+		plugin := *p
+		plugin.config = &config
+		plugin.pathOverrides = nil
+
+		overrides = append(overrides, pathOverride{path: strings.TrimSuffix(path, "/"), plugin: &plugin})
 	}
 
-	query.Apply()
+	// The most specific path takes precedence
+	sort.Slice(overrides, func(i, j int) bool {
+		return len(overrides[i].path) > len(overrides[j].path)
+	})
 
-	return result
+	return overrides
 }
 
-func (p *AuthHackPlugin) getAndScrubAuthQueryParam(query *requestQueryWrapper) encodedAuthWithoutPrefix {
-	var result encodedAuthWithoutPrefix
+// pathOverridePlugin returns the plugin for the most specific path key override matching the path, or this plugin.
+func (p *AuthHackPlugin) pathOverridePlugin(path string) *AuthHackPlugin {
+	for _, override := range p.pathOverrides {
+		if path == override.path || strings.HasPrefix(path, override.path+"/") {
+			return override.plugin
+		}
+	}
 
-	if authorization := query.Get(p.config.AuthorizationQueryParam); authorization != "" {
-		result = newEncodedAuthWithoutPrefix(authorization)
+	return p
+}
 
-		p.log(Debug, "found authorization query param ('%s': '%s'), moving to header", p.config.AuthorizationQueryParam, result)
+func (p *AuthHackPlugin) serveHTTP(responseWriter *responseHeaderWrapper, request *http.Request) {
+	p.log(Debug, "serving request '%s' ('%s')", request.URL, request.RequestURI)
 
-		query.Del(p.config.AuthorizationQueryParam)
-	}
+	// Before any pass-through, so that spoofed values never reach the next handler (or the access log)
+	p.scrubAccessLogHeaders(request)
+	p.scrubPHPAuthHeaders(request)
 
-	return result
-}
+	if endpoint, ok := p.endpoints[request.URL.Path]; ok {
+		p.log(Debug, "serving endpoint '%s'", request.URL.Path)
 
-func (p *AuthHackPlugin) getAndScrubUserPassQueryParams(query *requestQueryWrapper) encodedAuthWithoutPrefix {
-	var result encodedAuthWithoutPrefix
+		endpoint(responseWriter, request)
 
-	if username := query.Get(p.config.UsernameQueryParam); username != "" {
-		// Allow for not specifying a password
-		password := query.Get(p.config.PasswordQueryParam)
+		return
+	}
+
+	if p.isFromTrustedNetwork(request) {
+		// Requests from trusted networks already carry proper auth, leave them untouched
+		p.passThrough(responseWriter, request, "request is from a trusted network")
+
+		return
+	}
 
-		result = encodeAuthWithoutPrefix(username, password)
+	if p.config.SkipConditionalRequests && isConditionalRequest(request) {
+		// Revalidation of cached responses, avoid unnecessary credential handling. Clients control the conditional
+		// headers, so the credentials are still removed rather than leaked to the next handler.
+		p.scrubCredentials(request)
 
-		p.log(Debug, "found username and password query params ('%s': '%s' / '%s': '%s'), moving to header ('%s')", p.config.UsernameQueryParam, username, p.config.PasswordQueryParam, password, result.String())
+		p.passThrough(responseWriter, request, "request is conditional, removed credentials")
 
-		query.Del(p.config.UsernameQueryParam)
-		query.Del(p.config.PasswordQueryParam)
+		return
 	}
 
-	return result
-}
+	if p.config.StripOnPreflight && request.Method == http.MethodOptions {
+		// CORS preflights shouldn't trigger auth, but remove any credentials (e.g. from a followed link) for hygiene
+		p.scrubCredentials(request)
 
-func (p *AuthHackPlugin) getAndScrubAuthCookie(request *http.Request) encodedAuthWithoutPrefix {
-	cookies := request.Cookies()
-	for _, cookie := range cookies {
-		if cookie.Name == p.config.CookieName {
-			p.log(Debug, "found cookie ('%s': '%s'), removing from request", cookie.Name, cookie.Value)
+		p.passThrough(responseWriter, request, "request is a preflight, removed credentials")
 
-			p.removeCookie(request, cookies, cookie)
+		return
+	}
+
+	if p.config.RejectUnknownCredentialParams {
+		if key := p.findUnknownCredentialQueryParam(request); key != "" {
+			p.reject(responseWriter, request, http.StatusBadRequest, "found unknown credential-like query param ('%s')", key)
 
-			return newEncodedAuthWithoutPrefix(cookie.Value)
+			return
 		}
 	}
 
-	return emptyEncodedAuthWithoutPrefix
-}
+	p.checkMultiValuedAuthHeader(request)
 
-func (p *AuthHackPlugin) removeCookie(request *http.Request, cookies []*http.Cookie, cookie *http.Cookie) {
-	if cookies == nil {
-		cookies = request.Cookies()
+	if p.config.NormalizeIncomingScheme {
+		p.normalizeAuthHeaderScheme(request)
 	}
 
-	// HTTP API doesn't support removing cookies, so we have to do it ourselves.
-	// First, clear the cookie header.
-	request.Header.Del("Cookie")
+	hasAuthHeader := p.hasAuthHeader(request)
 
-	// Now, add each cookie back, skipping the removed cookie. Unfortunately, this results in many
-	// string allocations, but it's the only way to sanitize the cookie.
-	for _, otherCookie := range cookies {
-		if cookie == otherCookie {
-			continue
-		}
+	if p.config.LogForwardedURL {
+		p.log(Verbose, "URL before removing credentials: '%s'", p.redactURL(request.URL))
+	}
 
-		request.AddCookie(otherCookie)
+	// Even if we have an auth header, invoke the other handlers so they can scrub the request
+	queryParamsAuthWithoutPrefix := p.getAndScrubAuthQueryParams(request)
+	if !queryParamsAuthWithoutPrefix.IsEmpty() {
+		p.setReferrerPolicy(responseWriter)
+	}
+
+	cookieAuthWithoutPrefix, reissueCookie, cookieErr := p.getAndScrubAuthCookie(request)
+	if cookieErr != nil && p.config.RejectOnCookieCryptoError {
+		p.reject(responseWriter, request, http.StatusUnauthorized, "unable to decrypt or verify the cookie")
+
+		return
+	}
+
+	// Even if the plugin's cookie is set, scrub the credential cookie too
+	if credentialCookieAuth := p.getAndScrubCredentialQueryCookie(request); cookieAuthWithoutPrefix.IsEmpty() {
+		cookieAuthWithoutPrefix = credentialCookieAuth
+	}
+
+	if p.config.ScrubForwardedURI {
+		p.scrubForwardedURIHeaders(request)
+	}
+
+	if p.config.LogForwardedURL {
+		// The CSRF token is only moved when proxying, so it may still be in the URL
+		p.log(Verbose, "URL after removing credentials: '%s'", p.redactURL(request.URL))
 	}
+
+	if p.config.ForbidQueryCredentialsAfterCookie && !cookieAuthWithoutPrefix.IsEmpty() && !queryParamsAuthWithoutPrefix.IsEmpty() {
+		// Once the cookie is set, credentials should only come from it. This flags misbehaving clients or replayed links.
+		p.reject(responseWriter, request, http.StatusBadRequest, "found credentials in query params even though the cookie is set")
+
+		return
+	}
+
+	if !hasAuthHeader && !queryParamsAuthWithoutPrefix.IsEmpty() {
+		var err error
+		if queryParamsAuthWithoutPrefix, err = p.checkQueryCredentials(queryParamsAuthWithoutPrefix); err != nil {
+			p.reject(responseWriter, request, http.StatusBadRequest, "%v", err)
+
+			return
+		}
+	}
+
+	if p.usedCredentials != nil && !hasAuthHeader && !queryParamsAuthWithoutPrefix.IsEmpty() {
+		// Only the hash is kept so that the used credentials aren't held in memory
+		hash := sha256.Sum256([]byte(queryParamsAuthWithoutPrefix))
+		if !p.usedCredentials.Add(string(hash[:]), "") {
+			p.reject(responseWriter, request, http.StatusUnauthorized, "found credentials in query params that have already been used")
+
+			return
+		}
+	}
+
+	if hasAuthHeader {
+		// The request already has an auth header, prefer using that before anything from this plugin
+
+		p.log(Debug, "found authorization header, proxying request")
+
+		p.setDecision(responseWriter, request, decisionNoop, "", emptyEncodedAuthWithoutPrefix)
+
+		p.proxy(responseWriter, request)
+
+		return
+	}
+
+	if !queryParamsAuthWithoutPrefix.IsEmpty() && queryParamsAuthWithoutPrefix != cookieAuthWithoutPrefix {
+		// The request had auth specified by the query params that differs from the cookie (or the cookie isn't set),
+		// request that the client sets an auth cookie for subsequent requests and redirect them to the URL without
+		// query params set.
+
+		if p.config.GRPCWebQueryCredentials && isGRPCWebRequest(request) {
+			// gRPC-Web clients can't always set metadata headers from the browser, so use the credentials directly
+			p.log(Debug, "found gRPC-Web request, moving query param auth to header and proxying request")
+
+			if p.config.GRPCWebMetadataHeader {
+				request.Header.Set(grpcMetadataAuthorizationHeader, queryParamsAuthWithoutPrefix.WithPrefix().String())
+			}
+
+			p.applyQueryAuth(responseWriter, request, queryParamsAuthWithoutPrefix)
+
+			return
+		}
+
+		if err := p.validateRedirectTarget(request); err != nil {
+			// Never redirect somewhere else, but the (scrubbed) request itself can still be authenticated
+			p.log(Warning, "not redirecting to '%s': %v, moving query param auth to header and proxying request", request.RequestURI, err)
+
+			p.applyQueryAuth(responseWriter, request, queryParamsAuthWithoutPrefix)
+
+			return
+		}
+
+		if p.config.CookieOnGetOnly && request.Method != http.MethodGet && request.Method != http.MethodHead {
+			// Only browser navigation benefits from the cookie, API calls would just be redirected needlessly
+			p.log(Debug, "found '%s' request, moving query param auth to header and proxying request without setting cookie", request.Method)
+
+			p.applyQueryAuth(responseWriter, request, queryParamsAuthWithoutPrefix)
+
+			return
+		}
+
+		p.log(Debug, "cookie is unset or differs from provided auth, requesting redirect and set cookie")
+
+		p.setAccessLogHeaders(request, sourceQuery, queryParamsAuthWithoutPrefix)
+		p.warnOnQueryCredentials(responseWriter, request)
+
+		p.setDecision(responseWriter, request, decisionRedirected, sourceQuery, queryParamsAuthWithoutPrefix)
+		p.setNoStore(responseWriter)
+
+		// Set the cookie
+		cookie, err := p.newAuthCookie(queryParamsAuthWithoutPrefix)
+		if err != nil {
+			p.log(Error, "encountered error creating cookie: %v", err)
+			http.Error(responseWriter, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+
+			return
+		}
+		responseWriter.Header().Set("Set-Cookie", cookie.String())
+
+		// Request a redirect. HTTP 307 (Temporary Redirect) preserves the method and body.
+		responseWriter.Header().Set("Location", request.RequestURI)
+		responseWriter.WriteHeader(307)
+
+		_, err = responseWriter.Write(nil)
+		if err != nil {
+			p.log(Warning, "encountered error sending redirect response: %v", err)
+		}
+
+		return
+	}
+
+	if !cookieAuthWithoutPrefix.IsEmpty() {
+		// Add auth from the cookie before finally sending the request downstream. If the query params provided the same
+		// auth, the cookie is deliberately not set again (e.g. when a parent CookieDomain already shares it across
+		// subdomains) to avoid redundant Set-Cookie headers.
+
+		if !queryParamsAuthWithoutPrefix.IsEmpty() {
+			p.log(Debug, "cookie matches provided auth, not setting cookie again")
+		}
+
+		p.log(Debug, "found cookie, moving to authorization header and proxying request")
+
+		request.Header.Add(p.config.HeaderName, cookieAuthWithoutPrefix.WithPrefix().String())
+		p.setPHPAuthHeaders(request, cookieAuthWithoutPrefix)
+
+		if reissueCookie {
+			// The cookie was encrypted with the previous key (or should be re-signed), re-issue it with the current key
+			// and time. Added directly so that it doesn't clobber any cookies set by the downstream handler.
+			if cookie, err := p.newAuthCookie(cookieAuthWithoutPrefix); err != nil {
+				p.log(Error, "encountered error re-issuing cookie: %v", err)
+			} else {
+				p.log(Debug, "re-issuing cookie")
+
+				responseWriter.Header().Add("Set-Cookie", cookie.String())
+			}
+		}
+
+		p.setAccessLogHeaders(request, sourceCookie, cookieAuthWithoutPrefix)
+
+		p.setDecision(responseWriter, request, decisionApplied+sourceCookie, sourceCookie, cookieAuthWithoutPrefix)
+		p.setNoStore(responseWriter)
+	} else {
+		p.setDecision(responseWriter, request, decisionNoop, "", emptyEncodedAuthWithoutPrefix)
+	}
+
+	p.proxy(responseWriter, request)
+}
+
+// validateRedirectTarget checks that redirecting to the request URI (after removing the credentials) stays on the same
+// host and, if RedirectAllowedPrefixes is set, under an allowed path. The path is canonicalized first so that dot
+// segments can't escape the prefix.
+func (p *AuthHackPlugin) validateRedirectTarget(request *http.Request) error {
+	if strings.HasPrefix(request.RequestURI, "//") {
+		return fmt.Errorf("target is protocol-relative")
+	}
+
+	target, err := url.Parse(request.RequestURI)
+	if err != nil {
+		return fmt.Errorf("target can't be parsed: %w", err)
+	}
+
+	if target.Host != "" && !strings.EqualFold(target.Host, request.Host) {
+		return fmt.Errorf("target host ('%s') doesn't match the request host ('%s')", target.Host, request.Host)
+	}
+
+	if len(p.config.RedirectAllowedPrefixes) == 0 {
+		return nil
+	}
+
+	targetPath := path.Clean("/" + target.Path)
+
+	for _, prefix := range p.config.RedirectAllowedPrefixes {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if prefix == "" || targetPath == prefix || strings.HasPrefix(targetPath, prefix+"/") {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("target path ('%s') isn't under an allowed prefix", targetPath)
+}
+
+// applyQueryAuth moves the auth from the query params to the header and proxies the request, instead of redirecting
+// to set the cookie.
+func (p *AuthHackPlugin) applyQueryAuth(responseWriter *responseHeaderWrapper, request *http.Request, auth encodedAuthWithoutPrefix) {
+	request.Header.Set(p.config.HeaderName, auth.WithPrefix().String())
+	p.setPHPAuthHeaders(request, auth)
+
+	p.setAccessLogHeaders(request, sourceQuery, auth)
+	p.warnOnQueryCredentials(responseWriter, request)
+
+	p.setDecision(responseWriter, request, decisionApplied+sourceQuery, sourceQuery, auth)
+	p.setNoStore(responseWriter)
+
+	p.proxy(responseWriter, request)
+}
+
+// warnOnQueryCredentials flags that credentials were provided in the query params (if enabled), to track migrating
+// clients to the header or cookie.
+func (p *AuthHackPlugin) warnOnQueryCredentials(responseWriter *responseHeaderWrapper, request *http.Request) {
+	if !p.config.WarnOnQueryCredentials {
+		return
+	}
+
+	p.log(Warning, "found credentials in query params for '%s', which is deprecated", request.URL.Path)
+
+	if p.config.QueryCredentialsWarningHeader != "" {
+		responseWriter.Set(p.config.QueryCredentialsWarningHeader, queryCredentialsWarning)
+	}
+}
+
+// checkQueryCredentials checks the credentials from the query params against the credential policy and that they're
+// well-formed. Unless StrictCredentials is enabled, violations are only logged: credentials violating the policy are
+// skipped (empty auth is returned) and malformed credentials are used as-is. Otherwise, an error is returned.
+func (p *AuthHackPlugin) checkQueryCredentials(auth encodedAuthWithoutPrefix) (encodedAuthWithoutPrefix, error) {
+	if err := p.checkCredentialPolicy(auth); err != nil {
+		if p.config.StrictCredentials {
+			return emptyEncodedAuthWithoutPrefix, fmt.Errorf("found credentials in query params violating the credential policy: %w", err)
+		}
+
+		p.log(Warning, "found credentials in query params violating the credential policy, skipping: %v", err)
+
+		return emptyEncodedAuthWithoutPrefix, nil
+	}
+
+	if err := p.validateCredentials(auth); err != nil {
+		if p.config.StrictCredentials {
+			return emptyEncodedAuthWithoutPrefix, fmt.Errorf("found malformed credentials in query params: %w", err)
+		}
+
+		p.log(Warning, "found malformed credentials in query params, using as-is: %v", err)
+	}
+
+	return auth, nil
+}
+
+// validateCredentials checks that the credentials are well-formed.
+func (p *AuthHackPlugin) validateCredentials(auth encodedAuthWithoutPrefix) error {
+	if err := auth.Validate(); err != nil {
+		return err
+	}
+
+	if p.config.ValidateJWTStructure {
+		return auth.ValidateJWTStructure()
+	}
+
+	return nil
+}
+
+// checkCredentialPolicy checks the username and password against the configured lengths (in characters) and allowed
+// characters. Bearer tokens aren't checked.
+func (p *AuthHackPlugin) checkCredentialPolicy(auth encodedAuthWithoutPrefix) error {
+	if auth.IsBearer() {
+		return nil
+	}
+
+	username, password := auth.Username(), auth.Password()
+
+	if length := utf8.RuneCountInString(username); length < p.config.MinUsernameLength {
+		return fmt.Errorf("username is shorter than MinUsernameLength ('%v')", p.config.MinUsernameLength)
+	} else if p.config.MaxUsernameLength > 0 && length > p.config.MaxUsernameLength {
+		return fmt.Errorf("username is longer than MaxUsernameLength ('%v')", p.config.MaxUsernameLength)
+	}
+
+	if p.config.MaxPasswordLength > 0 && utf8.RuneCountInString(password) > p.config.MaxPasswordLength {
+		return fmt.Errorf("password is longer than MaxPasswordLength ('%v')", p.config.MaxPasswordLength)
+	}
+
+	if p.allowedCharacters != nil {
+		if !p.allowedCharacters.MatchString(username) {
+			return fmt.Errorf("username doesn't match AllowedCharactersPattern")
+		}
+
+		// A missing password is handled by the missing password policy instead
+		if password != "" && !p.allowedCharacters.MatchString(password) {
+			return fmt.Errorf("password doesn't match AllowedCharactersPattern")
+		}
+	}
+
+	return nil
+}
+
+// proxy sends the request to the next handler once the auth has been handled.
+func (p *AuthHackPlugin) proxy(responseWriter *responseHeaderWrapper, request *http.Request) {
+	p.moveCSRFQueryParam(request)
+
+	if !p.checkPreAuth(responseWriter, request) {
+		return
+	}
+
+	p.next.ServeHTTP(responseWriter, request)
+}
+
+// isGRPCWebRequest returns whether the request is gRPC-Web (e.g. `application/grpc-web+proto`), whose clients don't
+// follow redirects or store cookies like browsers navigating to a page do.
+func isGRPCWebRequest(request *http.Request) bool {
+	return strings.HasPrefix(strings.ToLower(request.Header.Get("Content-Type")), "application/grpc-web")
+}
+
+// extractionSources returns the enabled credential sources, in the order they take precedence.
+func (p *AuthHackPlugin) extractionSources() []string {
+	// An existing header always takes precedence
+	sources := []string{"header"}
+
+	userInfoSource := "url:userinfo"
+	if p.config.ReadURLUserInfo && p.config.PreferURLUserInfo {
+		sources = append(sources, userInfoSource)
+	}
+
+	if p.config.AuthorizationQueryParam != "" {
+		sources = append(sources, "query:"+p.config.AuthorizationQueryParam)
+	}
+
+	if p.config.UsernameQueryParam != "" {
+		sources = append(sources, "query:"+p.config.UsernameQueryParam+"/"+p.config.PasswordQueryParam)
+	}
+
+	if p.config.ProxyQueryParam != "" {
+		sources = append(sources, "query:"+p.config.ProxyQueryParam+" (user:pass@host)")
+	}
+
+	for _, key := range p.config.CredentialsKeys {
+		sources = append(sources, "query:"+key+" (user:pass)")
+	}
+
+	if p.config.NestedCredentialKey != "" {
+		sources = append(sources, "query:"+p.config.NestedCredentialKey+" (nested)")
+	}
+
+	if p.config.ReadURLUserInfo && !p.config.PreferURLUserInfo {
+		sources = append(sources, userInfoSource)
+	}
+
+	// Credentials from the URL take precedence over the cookie (and replace it)
+	sources = append(sources, "cookie:"+p.config.CookieName)
+
+	if p.config.CredentialQueryCookie != "" {
+		sources = append(sources, "cookie:"+p.config.CredentialQueryCookie+" (query string)")
+	}
+
+	return sources
+}
+
+func (p *AuthHackPlugin) log(level LogLevel, format string, args ...any) {
+	p.config.log(level, p.name, format, args...)
+}
+
+// scrubCredentials removes the credentials from the query params, the cookies and the forwarded URI headers without
+// using them.
+func (p *AuthHackPlugin) scrubCredentials(request *http.Request) {
+	p.getAndScrubAuthQueryParams(request)
+	// Cookie errors are already logged, and the cookie is removed either way
+	_, _, _ = p.getAndScrubAuthCookie(request)
+	p.getAndScrubCredentialQueryCookie(request)
+
+	if p.config.ScrubForwardedURI {
+		p.scrubForwardedURIHeaders(request)
+	}
+}
+
+// passThrough proxies the request without extracting any credentials (callers may have scrubbed them already).
+func (p *AuthHackPlugin) passThrough(responseWriter *responseHeaderWrapper, request *http.Request, reason string) {
+	p.log(Debug, "%s, proxying request untouched", reason)
+
+	p.setDecision(responseWriter, request, decisionNoop, "", emptyEncodedAuthWithoutPrefix)
+
+	// Still goes through proxy so that the pre-auth gate can't be skipped by e.g. just adding a conditional header, and
+	// the CSRF token doesn't reach the next handler in the URL
+	p.proxy(responseWriter, request)
+}
+
+// reject responds to the request with the given (error) status code instead of proxying it.
+func (p *AuthHackPlugin) reject(responseWriter *responseHeaderWrapper, request *http.Request, statusCode int, format string, args ...any) {
+	p.log(Info, "rejecting request with status code '%v': %s", statusCode, fmt.Sprintf(format, args...))
+
+	// Only delay rejections so that they're harder to tell apart from accepts via timing
+	if delay := p.getRejectJitter(); delay > 0 {
+		timer := time.NewTimer(delay)
+
+		// Don't hold on to the request once the client is gone
+		select {
+		case <-timer.C:
+		case <-request.Context().Done():
+			timer.Stop()
+		}
+	}
+
+	p.setDecision(responseWriter, request, decisionRejected, "", emptyEncodedAuthWithoutPrefix)
+
+	if statusCode == http.StatusUnauthorized {
+		p.setChallenges(responseWriter)
+	}
+
+	http.Error(responseWriter, http.StatusText(statusCode), statusCode)
+}
+
+// setChallenges adds a WWW-Authenticate header for each configured challenge scheme so that clients can choose how to
+// authenticate, unless the response already has challenges (e.g. from the pre-auth service).
+func (p *AuthHackPlugin) setChallenges(responseWriter *responseHeaderWrapper) {
+	if len(p.config.ChallengeSchemes) == 0 || responseWriter.Header().Get("WWW-Authenticate") != "" {
+		return
+	}
+
+	for _, scheme := range p.config.ChallengeSchemes {
+		var params []string
+		if p.config.ChallengeRealm != "" {
+			params = append(params, "realm="+strconv.Quote(p.config.ChallengeRealm))
+		}
+
+		// RFC 7617 allows advertising the charset of basic credentials, but only UTF-8
+		if strings.EqualFold(scheme, "Basic") && !strings.EqualFold(p.config.CredentialCharset, CharsetISO88591) {
+			params = append(params, `charset="UTF-8"`)
+		}
+
+		challenge := scheme
+		if len(params) > 0 {
+			challenge += " " + strings.Join(params, ", ")
+		}
+
+		responseWriter.Header().Add("WWW-Authenticate", challenge)
+	}
+}
+
+// getRejectJitter returns a random duration between the configured minimum and maximum reject jitter.
+func (p *AuthHackPlugin) getRejectJitter() time.Duration {
+	minimum := time.Duration(p.config.RejectJitterMinMs) * time.Millisecond
+	maximum := time.Duration(p.config.RejectJitterMaxMs) * time.Millisecond
+
+	if maximum <= minimum {
+		return minimum
+	}
+
+	return minimum + time.Duration(rand.Int63n(int64(maximum-minimum)))
+}
+
+// setDecision describes what the plugin did with the request in the decision response header, the decision history
+// and the metrics (if enabled). The source and auth are empty unless credentials were used.
+func (p *AuthHackPlugin) setDecision(responseWriter *responseHeaderWrapper, request *http.Request, decision, source string, auth encodedAuthWithoutPrefix) {
+	if p.metrics != nil {
+		p.metrics.Record(decision, source)
+	}
+
+	if p.decisionHistory != nil {
+		p.decisionHistory.Add(decisionRecord{
+			Time:     time.Now(),
+			Decision: decision,
+			Source:   source,
+			Path:     request.URL.Path,
+			User:     redactUsername(auth.Username()),
+		})
+	}
+
+	if p.config.DecisionResponseHeader == "" {
+		return
+	}
+
+	responseWriter.Set(p.config.DecisionResponseHeader, decision)
+}
+
+// setNoStore prevents intermediaries from caching responses to requests the plugin provided credentials for (if
+// enabled).
+func (p *AuthHackPlugin) setNoStore(responseWriter *responseHeaderWrapper) {
+	if !p.config.NoStoreOnAuth {
+		return
+	}
+
+	responseWriter.Set("Cache-Control", "no-store")
+}
+
+// setReferrerPolicy stops the browser from sending the URL the credentials were provided in as the referrer of
+// subsequent requests (e.g. to resources loaded by the page or links followed from it), if enabled.
+func (p *AuthHackPlugin) setReferrerPolicy(responseWriter *responseHeaderWrapper) {
+	if !p.config.SetReferrerPolicy {
+		return
+	}
+
+	responseWriter.Set("Referrer-Policy", "no-referrer")
+}
+
+// credentialQueryParams returns the names of the configured query params that may carry credentials.
+func (p *AuthHackPlugin) credentialQueryParams() []string {
+	var keys []string
+	for _, key := range append([]string{p.config.UsernameQueryParam, p.config.PasswordQueryParam, p.config.AuthorizationQueryParam, p.config.ProxyQueryParam, p.config.NestedCredentialKey, p.config.CSRFKey}, p.config.CredentialsKeys...) {
+		if key != "" {
+			keys = append(keys, key)
+
+			if p.config.AllowArraySyntax {
+				keys = append(keys, key+arraySyntaxSuffix)
+			}
+		}
+	}
+
+	return keys
+}
+
+// isCredentialQueryParam returns whether the query param is one of the credential query params (case-insensitively if
+// CaseInsensitiveKeys is enabled).
+func (p *AuthHackPlugin) isCredentialQueryParam(key string) bool {
+	if p.config.CaseInsensitiveKeys {
+		return containsStringFold(p.credentialQueryParams(), key)
+	}
+
+	return containsString(p.credentialQueryParams(), key)
+}
+
+// redactURL returns the URL with the values of any credentials (including the CSRF token) replaced.
+func (p *AuthHackPlugin) redactURL(u *url.URL) string {
+	const redacted = "xxxxx"
+
+	redactedURL := *u
+
+	if redactedURL.User != nil {
+		redactedURL.User = url.UserPassword(redacted, redacted)
+	}
+
+	query := redactedURL.Query()
+	for key := range query {
+		if p.isCredentialQueryParam(key) {
+			query.Set(key, redacted)
+		}
+	}
+	redactedURL.RawQuery = query.Encode()
+
+	return redactedURL.String()
+}
+
+// findUnknownCredentialQueryParam returns the name of the first query param that looks like it carries credentials
+// but isn't configured (or known to be safe), or an empty string if there isn't any.
+func (p *AuthHackPlugin) findUnknownCredentialQueryParam(request *http.Request) string {
+	for key := range request.URL.Query() {
+		if p.isCredentialQueryParam(key) || containsString(p.config.KnownSafeQueryParams, key) {
+			continue
+		}
+
+		lowerKey := strings.ToLower(key)
+		for _, pattern := range credentialLikeQueryParamPatterns {
+			if strings.Contains(lowerKey, pattern) {
+				return key
+			}
+		}
+	}
+
+	return ""
+}
+
+func (p *AuthHackPlugin) isFromTrustedNetwork(request *http.Request) bool {
+	if len(p.trustedNetworks) == 0 {
+		return false
+	}
+
+	return containsIP(p.trustedNetworks, getClientIP(request, p.trustedProxies))
+}
+
+func isConditionalRequest(request *http.Request) bool {
+	return request.Header.Get("If-None-Match") != "" || request.Header.Get("If-Modified-Since") != ""
+}
+
+func (p *AuthHackPlugin) hasAuthHeader(request *http.Request) bool {
+	return request.Header.Get(p.config.HeaderName) != ""
+}
+
+// checkMultiValuedAuthHeader warns about requests with multiple authorization header values, since only the first is
+// considered by the plugin (and downstream services may disagree on which one to use).
+func (p *AuthHackPlugin) checkMultiValuedAuthHeader(request *http.Request) {
+	values := request.Header.Values(p.config.HeaderName)
+	if len(values) <= 1 {
+		return
+	}
+
+	if p.config.CollapseMultiAuth {
+		p.log(Warning, "found %v authorization header values, collapsing to the first", len(values))
+
+		request.Header.Set(p.config.HeaderName, values[0])
+	} else {
+		p.log(Warning, "found %v authorization header values, only the first is considered", len(values))
+	}
+}
+
+func (p *AuthHackPlugin) normalizeAuthHeaderScheme(request *http.Request) {
+	value := request.Header.Get(p.config.HeaderName)
+	if value == "" {
+		return
+	}
+
+	if normalized := normalizeAuthScheme(value); normalized != value {
+		p.log(Debug, "normalized authorization header scheme ('%s' to '%s')", value, normalized)
+
+		request.Header.Set(p.config.HeaderName, normalized)
+	}
+}
+
+// scrubAccessLogHeaders removes any access log headers provided by the client so that they can't be spoofed.
+func (p *AuthHackPlugin) scrubAccessLogHeaders(request *http.Request) {
+	if !p.config.AccessLogHeaders {
+		return
+	}
+
+	request.Header.Del(SourceHeader)
+	request.Header.Del(UserHeader)
+}
+
+func (p *AuthHackPlugin) setAccessLogHeaders(request *http.Request, source string, auth encodedAuthWithoutPrefix) {
+	if !p.config.AccessLogHeaders {
+		return
+	}
+
+	request.Header.Set(SourceHeader, source)
+	request.Header.Set(UserHeader, auth.Username())
+}
+
+// scrubPHPAuthHeaders removes any PHP auth headers provided by the client so that they can't be spoofed.
+func (p *AuthHackPlugin) scrubPHPAuthHeaders(request *http.Request) {
+	if !p.config.EmitPHPAuthHeaders {
+		return
+	}
+
+	request.Header.Del(PHPAuthUserHeader)
+	request.Header.Del(PHPAuthPwHeader)
+}
+
+// setPHPAuthHeaders sets the PHP auth headers from basic credentials, bearer tokens have no username / password.
+func (p *AuthHackPlugin) setPHPAuthHeaders(request *http.Request, auth encodedAuthWithoutPrefix) {
+	if !p.config.EmitPHPAuthHeaders || auth.IsBearer() {
+		return
+	}
+
+	request.Header.Set(PHPAuthUserHeader, auth.Username())
+	request.Header.Set(PHPAuthPwHeader, auth.Password())
+}
+
+func (p *AuthHackPlugin) getAndScrubAuthQueryParams(request *http.Request) encodedAuthWithoutPrefix {
+	query := newQueryWrapper(request)
+
+	result := p.getAndScrubAuthQueryParam(request, query)
+
+	// Even if we already have a result, continue to run the remaining handlers so they all get a chance to sanitize the request
+	userAndPassResult := p.getAndScrubUserPassQueryParams(query)
+	if result.IsEmpty() {
+		result = userAndPassResult
+	} else if result != userAndPassResult {
+		p.log(Info, "found both authorization query param and username / password query params that are mismatched, using authorization query param")
+	}
+
+	proxyResult := p.getAndScrubProxyQueryParam(query)
+	if result.IsEmpty() {
+		result = proxyResult
+	} else if !proxyResult.IsEmpty() && result != proxyResult {
+		p.log(Info, "found both proxy query param and other query params that are mismatched, using the other query params")
+	}
+
+	credentialsResult := p.getAndScrubCredentialsQueryParams(query)
+	if result.IsEmpty() {
+		result = credentialsResult
+	} else if !credentialsResult.IsEmpty() && result != credentialsResult {
+		p.log(Info, "found both credentials query param and other query params that are mismatched, using the other query params")
+	}
+
+	nestedResult := p.getAndScrubNestedCredentialQueryParam(request, query)
+	if result.IsEmpty() {
+		result = nestedResult
+	} else if !nestedResult.IsEmpty() && result != nestedResult {
+		p.log(Info, "found both nested credential query param and other query params that are mismatched, using the other query params")
+	}
+
+	query.Apply()
+
+	// The user info is always scrubbed (when enabled), even if it's ignored in favor of the query params
+	userInfoResult := p.getAndScrubURLUserInfo(request)
+	if !userInfoResult.IsEmpty() {
+		if result.IsEmpty() {
+			result = userInfoResult
+		} else if result != userInfoResult {
+			if p.config.PreferURLUserInfo {
+				p.log(Info, "found both URL user info and query params that are mismatched, using URL user info")
+
+				result = userInfoResult
+			} else {
+				p.log(Info, "found both URL user info and query params that are mismatched, using query params")
+			}
+		}
+	}
+
+	return result
+}
+
+// getAndScrubProxyQueryParam gets the credentials from the proxy query param, in the SOCKS-style `user:pass@host` (or
+// `user@host`) form. The param is removed, or rewritten to just the host if RewriteProxyQueryParam is enabled.
+func (p *AuthHackPlugin) getAndScrubProxyQueryParam(query *requestQueryWrapper) encodedAuthWithoutPrefix {
+	var result encodedAuthWithoutPrefix
+
+	if p.config.ProxyQueryParam == "" {
+		return result
+	}
+
+	value := p.getCredentialQueryParam(query, p.config.ProxyQueryParam)
+	if value == "" {
+		return result
+	}
+
+	p.delCredentialQueryParam(query, p.config.ProxyQueryParam)
+
+	// The host can't contain '@', but the password might
+	i := strings.LastIndexByte(value, '@')
+	if i <= 0 || i == len(value)-1 {
+		p.log(Warning, "proxy query param ('%s') isn't in the form 'user:pass@host', ignoring", p.config.ProxyQueryParam)
+
+		return result
+	}
+
+	userInfo, host := value[:i], value[i+1:]
+
+	username, password := splitCombinedCredentials(userInfo)
+	if username == "" {
+		p.log(Warning, "proxy query param ('%s') doesn't have a username, ignoring", p.config.ProxyQueryParam)
+
+		return result
+	}
+
+	if password == "" && p.config.MissingPasswordPolicy == MissingPasswordSkip {
+		p.log(Verbose, "found proxy query param ('%s') without password, skipping", p.config.ProxyQueryParam)
+	} else {
+		result = p.encodeAuth(username, password)
+
+		p.log(Debug, "found proxy query param ('%s': '%s'), moving to header ('%s')", p.config.ProxyQueryParam, value, result.String())
+	}
+
+	if p.config.RewriteProxyQueryParam {
+		query.Set(p.config.ProxyQueryParam, host)
+	}
+
+	return result
+}
+
+// splitCombinedCredentials splits credentials in the `username:password` form, the password is empty if there's no
+// colon. Only the first colon separates them, since the password may contain colons (but the username can't).
+func splitCombinedCredentials(value string) (username, password string) {
+	username, password, _ = strings.Cut(value, ":")
+
+	return username, password
+}
+
+// getAndScrubCredentialsQueryParams gets the credentials in the `user:pass` (or `user`) form from the first of the
+// CredentialsKeys query params present. All of them are removed, even those after the one used.
+func (p *AuthHackPlugin) getAndScrubCredentialsQueryParams(query *requestQueryWrapper) encodedAuthWithoutPrefix {
+	var result encodedAuthWithoutPrefix
+	found := false
+
+	for _, key := range p.config.CredentialsKeys {
+		value := p.getCredentialQueryParam(query, key)
+		if value == "" {
+			continue
+		}
+
+		p.delCredentialQueryParam(query, key)
+
+		if found {
+			p.log(Debug, "found credentials query param ('%s') after an earlier one, ignoring", key)
+
+			continue
+		}
+
+		found = true
+
+		username, password := splitCombinedCredentials(value)
+		if username == "" {
+			p.log(Warning, "credentials query param ('%s') doesn't have a username, ignoring", key)
+
+			continue
+		}
+
+		if password == "" && p.config.MissingPasswordPolicy == MissingPasswordSkip {
+			p.log(Verbose, "found credentials query param ('%s') without password, skipping", key)
+
+			continue
+		}
+
+		result = p.encodeAuth(username, password)
+
+		p.log(Debug, "found credentials query param ('%s': '%s'), moving to header ('%s')", key, value, result.String())
+	}
+
+	return result
+}
+
+// getAndScrubNestedCredentialQueryParam extracts credentials from the query of a URL nested in a query param (e.g.
+// `?login=myapp%3A%2F%2Flogin%3Fusername%3Dx%26password%3Dy`), using the same query params as the request.
+func (p *AuthHackPlugin) getAndScrubNestedCredentialQueryParam(request *http.Request, query *requestQueryWrapper) encodedAuthWithoutPrefix {
+	var result encodedAuthWithoutPrefix
+
+	if p.config.NestedCredentialKey == "" {
+		return result
+	}
+
+	value := p.getCredentialQueryParam(query, p.config.NestedCredentialKey)
+	if value == "" {
+		return result
+	}
+
+	p.delCredentialQueryParam(query, p.config.NestedCredentialKey)
+
+	nestedURL, err := url.Parse(value)
+	if err != nil {
+		p.log(Warning, "unable to parse nested credential query param ('%s'), ignoring: %v", p.config.NestedCredentialKey, err)
+
+		return result
+	}
+
+	if !containsStringFold(p.config.NestedCredentialSchemes, nestedURL.Scheme) {
+		p.log(Warning, "nested credential query param ('%s') has a scheme ('%s') that isn't allowed, ignoring", p.config.NestedCredentialKey, nestedURL.Scheme)
+
+		return result
+	}
+
+	p.log(Debug, "found nested credential query param ('%s': '%s')", p.config.NestedCredentialKey, value)
+
+	return p.getEmbeddedQueryCredentials(request, nestedURL)
+}
+
+// getEmbeddedQueryCredentials gets the credentials from the query of a URL embedded in the request (e.g. a nested
+// URL). The URL is never applied to the request, it's only wrapped to reuse the query param handling.
+func (p *AuthHackPlugin) getEmbeddedQueryCredentials(request *http.Request, embeddedURL *url.URL) encodedAuthWithoutPrefix {
+	embeddedQuery := newQueryWrapper(&http.Request{URL: embeddedURL, Header: request.Header})
+
+	result := p.getAndScrubAuthQueryParam(request, embeddedQuery)
+	if userAndPassResult := p.getAndScrubUserPassQueryParams(embeddedQuery); result.IsEmpty() {
+		result = userAndPassResult
+	}
+
+	return result
+}
+
+func (p *AuthHackPlugin) getAndScrubURLUserInfo(request *http.Request) encodedAuthWithoutPrefix {
+	var result encodedAuthWithoutPrefix
+
+	if !p.config.ReadURLUserInfo || request.URL.User == nil {
+		return result
+	}
+
+	if username := request.URL.User.Username(); username != "" {
+		password, _ := request.URL.User.Password()
+
+		result = p.encodeAuth(username, password)
+
+		p.log(Debug, "found URL user info ('%s' / '%s'), moving to header ('%s')", username, password, result.String())
+	}
+
+	request.URL.User = nil
+	request.RequestURI = request.URL.String()
+
+	return result
+}
+
+func (p *AuthHackPlugin) getAndScrubAuthQueryParam(request *http.Request, query *requestQueryWrapper) encodedAuthWithoutPrefix {
+	var result encodedAuthWithoutPrefix
+
+	if authorization := p.getCredentialQueryParam(query, p.config.AuthorizationQueryParam); authorization != "" {
+		if p.config.DoubleDecodeAuthorization {
+			authorization = p.decodeAuthorizationQueryParam(authorization)
+		}
+
+		if p.config.AuthorizationFromHeaderKey {
+			authorization = p.getAndScrubReferencedHeader(request, authorization)
+		}
+
+		if token, ok := p.trimBearerMarker(authorization); ok {
+			result = newBearerAuth(token)
+		} else if authorization != "" {
+			result = newEncodedAuthWithoutPrefix(authorization)
+
+			p.log(Debug, "found authorization query param ('%s': '%s'), moving to header", p.config.AuthorizationQueryParam, result)
+		}
+
+		p.delCredentialQueryParam(query, p.config.AuthorizationQueryParam)
+	}
+
+	return result
+}
+
+// getCredentialQueryParam gets the value of a query param that carries credentials. Unless StrictPlusDecoding is
+// enabled, '+' is interpreted literally since it's more likely to be part of a password (or base64) than a space.
+func (p *AuthHackPlugin) getCredentialQueryParam(query *requestQueryWrapper, key string) string {
+	for _, matchingKey := range p.credentialQueryParamKeys(query, key) {
+		if value := p.getQueryParam(query, matchingKey); value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// credentialQueryParamKeys returns the names of the query params that provide the credential query param: the name
+// itself and its array syntax alias (if AllowArraySyntax is enabled). If CaseInsensitiveKeys is enabled, any
+// differently cased names present in the query follow (sorted, so that the same one always wins).
+func (p *AuthHackPlugin) credentialQueryParamKeys(query *requestQueryWrapper, key string) []string {
+	keys := []string{key}
+	if p.config.AllowArraySyntax {
+		keys = append(keys, key+arraySyntaxSuffix)
+	}
+
+	if !p.config.CaseInsensitiveKeys {
+		return keys
+	}
+
+	var otherCasedKeys []string
+	for _, queryKey := range query.Keys() {
+		if !containsString(keys, queryKey) && containsStringFold(keys, queryKey) {
+			otherCasedKeys = append(otherCasedKeys, queryKey)
+		}
+	}
+	sort.Strings(otherCasedKeys)
+
+	return append(keys, otherCasedKeys...)
+}
+
+func (p *AuthHackPlugin) getQueryParam(query *requestQueryWrapper, key string) string {
+	if p.config.StrictPlusDecoding {
+		return query.Get(key)
+	}
+
+	return query.GetLiteralPlus(key)
+}
+
+func (p *AuthHackPlugin) hasCredentialQueryParam(query *requestQueryWrapper, key string) bool {
+	for _, matchingKey := range p.credentialQueryParamKeys(query, key) {
+		if query.Has(matchingKey) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *AuthHackPlugin) delCredentialQueryParam(query *requestQueryWrapper, key string) {
+	for _, matchingKey := range p.credentialQueryParamKeys(query, key) {
+		query.Del(matchingKey)
+	}
+}
+
+// trimBearerMarker removes the first (case-insensitively) matching bearer marker from the authorization query param
+// value, returning the remaining token and whether a marker was found.
+func (p *AuthHackPlugin) trimBearerMarker(authorization string) (string, bool) {
+	for _, marker := range p.config.BearerMarkers {
+		if len(authorization) > len(marker) && strings.EqualFold(authorization[:len(marker)], marker) {
+			return authorization[len(marker):], true
+		}
+	}
+
+	return "", false
+}
+
+// getAndScrubReferencedHeader returns the value of the header named by the authorization query param, removing it
+// from the request. Returns an empty string if the header isn't allowed to be referenced or doesn't exist.
+func (p *AuthHackPlugin) getAndScrubReferencedHeader(request *http.Request, headerName string) string {
+	// The client picks the header, so without the allowlist it could e.g. turn the cookie or a header set by a proxy
+	// into credentials (and remove it)
+	if !containsStringFold(p.config.AllowedReferencedHeaders, headerName) {
+		p.log(Warning, "authorization query param ('%s') references header ('%s') that isn't allowed, ignoring", p.config.AuthorizationQueryParam, headerName)
+
+		return ""
+	}
+
+	value := request.Header.Get(headerName)
+	if value == "" {
+		p.log(Warning, "authorization query param ('%s') references header ('%s') that doesn't exist, ignoring", p.config.AuthorizationQueryParam, headerName)
+
+		return ""
+	}
+
+	p.log(Debug, "found header ('%s': '%s') referenced by authorization query param, removing from request", headerName, value)
+
+	request.Header.Del(headerName)
+
+	return value
+}
+
+// encodeAuth encodes the username and password using the configured charset. Returns empty auth if the credentials
+// can't be encoded.
+func (p *AuthHackPlugin) encodeAuth(username, password string) encodedAuthWithoutPrefix {
+	result, err := encodeAuthWithoutPrefixCharset(username, password, p.config.CredentialCharset)
+	if err != nil {
+		p.log(Warning, "unable to encode credentials using charset '%s', ignoring: %v", p.config.CredentialCharset, err)
+
+		return emptyEncodedAuthWithoutPrefix
+	}
+
+	return result
+}
+
+// decodeAuthorizationQueryParam applies a second round of URL decoding to authorization query param values that were
+// double-encoded. Values that don't look encoded or fail to decode are returned unchanged.
+func (p *AuthHackPlugin) decodeAuthorizationQueryParam(authorization string) string {
+	// Only decode if there is something to decode, otherwise '+' in a single-encoded value would be turned into a space
+	if !strings.Contains(authorization, "%") {
+		return authorization
+	}
+
+	decoded, err := url.QueryUnescape(authorization)
+	if err != nil {
+		p.log(Verbose, "unable to decode authorization query param a second time, using as-is: %v", err)
+
+		return authorization
+	}
+
+	return decoded
+}
+
+func (p *AuthHackPlugin) getAndScrubUserPassQueryParams(query *requestQueryWrapper) encodedAuthWithoutPrefix {
+	var result encodedAuthWithoutPrefix
+
+	username := p.getCredentialQueryParam(query, p.config.UsernameQueryParam)
+	// Allow for not specifying a password (depending on the missing password policy)
+	password := p.getCredentialQueryParam(query, p.config.PasswordQueryParam)
+
+	if strings.Contains(username, ":") {
+		// Usually `user:pass` pasted into the username param, which can't be represented in basic auth (RFC 7617)
+		if p.config.AutoSplitUsernameColon && password == "" {
+			p.log(Warning, "found username query param ('%s') containing a colon without a password query param ('%s'), splitting it into the username and password", p.config.UsernameQueryParam, p.config.PasswordQueryParam)
+
+			username, password = splitCombinedCredentials(username)
+		} else {
+			p.log(Warning, "found username query param ('%s') containing a colon, the password should be provided in the password query param ('%s') instead", p.config.UsernameQueryParam, p.config.PasswordQueryParam)
+		}
+	}
+
+	hasUsername := username != "" || (p.config.AllowEmptyUsername && p.hasCredentialQueryParam(query, p.config.UsernameQueryParam))
+
+	if username == "" && password != "" && p.config.FallbackUsername != "" {
+		// Only a password / token was provided, use the fallback username so that a valid header can still be built
+		p.log(Debug, "found password query param without username, using fallback username ('%s')", p.config.FallbackUsername)
+
+		username = p.config.FallbackUsername
+		hasUsername = true
+	}
+
+	if hasUsername {
+		if password == "" && p.config.MissingPasswordPolicy == MissingPasswordSkip {
+			p.log(Verbose, "found username query param ('%s': '%s') without password, skipping", p.config.UsernameQueryParam, username)
+		} else {
+			// Note that if both the username and password are empty, this results in the encoding of ':' ("Og==")
+			result = p.encodeAuth(username, password)
+
+			p.log(Debug, "found username and password query params ('%s': '%s' / '%s': '%s'), moving to header ('%s')", p.config.UsernameQueryParam, username, p.config.PasswordQueryParam, password, result.String())
+		}
+
+		p.delCredentialQueryParam(query, p.config.UsernameQueryParam)
+		p.delCredentialQueryParam(query, p.config.PasswordQueryParam)
+	}
+
+	return result
+}
+
+// moveCSRFQueryParam moves the CSRF token from the query params to the CSRF header. This is only done when proxying
+// (or passing through) the request so that the token is preserved in the redirect that sets the auth cookie.
+func (p *AuthHackPlugin) moveCSRFQueryParam(request *http.Request) {
+	if p.config.CSRFKey == "" || p.config.CSRFHeaderName == "" {
+		return
+	}
+
+	query := newQueryWrapper(request)
+
+	// Matched like the credential query params, so that every key that's redacted from the logs is also moved
+	if token := p.getCredentialQueryParam(query, p.config.CSRFKey); token != "" {
+		p.log(Debug, "found CSRF query param ('%s': '%s'), moving to header ('%s')", p.config.CSRFKey, token, p.config.CSRFHeaderName)
+
+		request.Header.Set(p.config.CSRFHeaderName, token)
+
+		p.delCredentialQueryParam(query, p.config.CSRFKey)
+	}
+
+	query.Apply()
+}
+
+// scrubForwardedURIHeaders removes the credential query params from headers that contain the original URI of the
+// request, since they would otherwise leak the credentials to the downstream service.
+func (p *AuthHackPlugin) scrubForwardedURIHeaders(request *http.Request) {
+	for _, header := range forwardedURIHeaders {
+		value := request.Header.Get(header)
+		if value == "" {
+			continue
+		}
+
+		uri, err := url.Parse(value)
+		if err != nil {
+			p.log(Warning, "unable to parse '%s' header, removing it: %v", header, err)
+
+			request.Header.Del(header)
+
+			continue
+		}
+
+		scrubbedKeys := map[string]bool{}
+		for key := range uri.Query() {
+			if p.isCredentialQueryParam(key) {
+				scrubbedKeys[key] = true
+			}
+		}
+
+		if len(scrubbedKeys) > 0 {
+			uri.RawQuery = removeRawQueryParams(uri.RawQuery, scrubbedKeys)
+
+			p.log(Debug, "removed credentials from '%s' header", header)
+
+			request.Header.Set(header, uri.String())
+		}
+	}
+}
+
+// getAndScrubAuthCookie returns the auth from the cookie and whether the cookie should be re-issued (because it was
+// encrypted with the previous key or ResignCookieOnUse is enabled). If the cookie can't be decrypted or verified, it
+// fails closed: the error is returned and the cookie is treated as absent, so nothing from it is ever forwarded.
+func (p *AuthHackPlugin) getAndScrubAuthCookie(request *http.Request) (encodedAuthWithoutPrefix, bool, error) {
+	cookies := request.Cookies()
+	for _, cookie := range cookies {
+		if cookie.Name == p.config.CookieName {
+			if p.config.StripOwnCookie {
+				p.log(Debug, "found cookie ('%s': '%s'), removing from request", cookie.Name, cookie.Value)
+
+				p.removeCookie(request, cookies, cookie)
+			} else {
+				p.log(Debug, "found cookie ('%s': '%s')", cookie.Name, cookie.Value)
+			}
+
+			value := cookie.Value
+			reissue := false
+
+			if p.cookieSigner != nil {
+				var err error
+				value, err = p.cookieSigner.Verify(value)
+				if err != nil {
+					// Treat the cookie as missing so that the client is asked for credentials again
+					p.log(Error, "encountered error verifying cookie ('%s'), ignoring: %v", cookie.Name, err)
+
+					return emptyEncodedAuthWithoutPrefix, false, err
+				}
+
+				// Keep the signature fresh so that active sessions don't expire
+				reissue = p.config.ResignCookieOnUse
+			}
+
+			if p.cookieCipher != nil {
+				var usedPrevious bool
+				var err error
+				value, usedPrevious, err = p.cookieCipher.Decrypt(value)
+				if err != nil {
+					p.log(Error, "encountered error decrypting cookie ('%s'), ignoring: %v", cookie.Name, err)
+
+					return emptyEncodedAuthWithoutPrefix, false, err
+				}
+
+				reissue = reissue || usedPrevious
+			}
+
+			return newEncodedAuthWithoutPrefix(value), reissue, nil
+		}
+	}
+
+	return emptyEncodedAuthWithoutPrefix, false, nil
+}
+
+// newAuthCookie creates the cookie used to carry the auth across requests, encrypting and signing its value if enabled.
+func (p *AuthHackPlugin) newAuthCookie(auth encodedAuthWithoutPrefix) (*http.Cookie, error) {
+	value := auth.String()
+
+	if p.cookieCipher != nil {
+		var err error
+		value, err = p.cookieCipher.Encrypt(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.cookieSigner != nil {
+		value = p.cookieSigner.Sign(value)
+	}
+
+	return &http.Cookie{
+		Name:     p.config.CookieName,
+		Value:    value,
+		Domain:   p.config.CookieDomain,
+		Path:     p.config.CookiePath,
+		Secure:   true, // HTTPS only
+		HttpOnly: true, // Unavailable to JavaScript
+		SameSite: http.SameSiteStrictMode,
+	}, nil
+}
+
+// getAndScrubCredentialQueryCookie returns the auth from the credential cookie, whose value is a query string using the
+// configured query param names (e.g. `username=username&password=password`).
+func (p *AuthHackPlugin) getAndScrubCredentialQueryCookie(request *http.Request) encodedAuthWithoutPrefix {
+	if p.config.CredentialQueryCookie == "" {
+		return emptyEncodedAuthWithoutPrefix
+	}
+
+	cookies := request.Cookies()
+	for _, cookie := range cookies {
+		if cookie.Name != p.config.CredentialQueryCookie {
+			continue
+		}
+
+		if p.config.StripOwnCookie {
+			p.log(Debug, "found credential cookie ('%s': '%s'), removing from request", cookie.Name, cookie.Value)
+
+			p.removeCookie(request, cookies, cookie)
+		} else {
+			p.log(Debug, "found credential cookie ('%s': '%s')", cookie.Name, cookie.Value)
+		}
+
+		return p.getEmbeddedQueryCredentials(request, &url.URL{RawQuery: cookie.Value})
+	}
+
+	return emptyEncodedAuthWithoutPrefix
+}
+
+func (p *AuthHackPlugin) removeCookie(request *http.Request, cookies []*http.Cookie, cookie *http.Cookie) {
+	if cookies == nil {
+		cookies = request.Cookies()
+	}
+
+	// HTTP API doesn't support removing cookies, so we have to do it ourselves.
+	// First, clear the cookie header.
+	request.Header.Del("Cookie")
+
+	// Now, add each cookie back, skipping the removed cookie. Unfortunately, this results in many
+	// string allocations, but it's the only way to sanitize the cookie.
+	for _, otherCookie := range cookies {
+		if cookie == otherCookie {
+			continue
+		}
+
+		request.AddCookie(otherCookie)
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsStringFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+
+	return false
 }
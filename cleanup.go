@@ -0,0 +1,60 @@
+package traefik_authhack
+
+import (
+	"sync"
+	"time"
+)
+
+// cleanup periodically evicts expired entries from the plugin's in-memory state, so that entries that are never added
+// again don't linger until they're pushed out by newer ones.
+type cleanup struct {
+	caches []*ttlCache
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// startCleanup starts the cleanup goroutine for the caches, which runs until stopped.
+func startCleanup(interval time.Duration, caches ...*ttlCache) *cleanup {
+	c := &cleanup{
+		caches: caches,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	go c.run(interval)
+
+	return c
+}
+
+func (c *cleanup) run(interval time.Duration) {
+	defer close(c.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.evictExpired()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *cleanup) evictExpired() {
+	for _, cache := range c.caches {
+		cache.EvictExpired()
+	}
+}
+
+// Stop stops the cleanup goroutine and waits for it to exit. It's safe to call more than once.
+func (c *cleanup) Stop() {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+	})
+
+	<-c.done
+}
@@ -0,0 +1,96 @@
+package traefik_authhack
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCleanup_EvictsExpired(t *testing.T) {
+	expired := newTTLCache(2, time.Minute)
+	expired.now = func() time.Time { return time.Now().Add(-time.Hour) }
+	expired.Add("a", "1")
+	expired.now = time.Now
+
+	live := newTTLCache(2, time.Minute)
+	live.Add("b", "2")
+
+	c := startCleanup(time.Millisecond, expired, live)
+	defer c.Stop()
+
+	deadline := time.Now().Add(time.Second)
+	for expired.Len() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected expired entry to be evicted")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if live.Len() != 1 {
+		t.Errorf("expected live entry to remain")
+	}
+}
+
+func TestCleanup_Stop(t *testing.T) {
+	c := startCleanup(time.Hour)
+
+	c.Stop()
+
+	select {
+	case <-c.done:
+	default:
+		t.Fatalf("expected the goroutine to have exited")
+	}
+
+	// Stopping again is a no-op
+	c.Stop()
+}
+
+func TestAuthHackPlugin_Close(t *testing.T) {
+	tests := []struct {
+		name            string
+		configure       func(config *Config)
+		expectedCleanup bool
+	}{
+		{name: "Disabled", configure: func(config *Config) { config.SingleUseCredentials = true }},
+		{name: "NoCaches", configure: func(config *Config) { config.CleanupIntervalSeconds = 1 }},
+		{name: "Enabled", configure: func(config *Config) {
+			config.CleanupIntervalSeconds = 1
+			config.SingleUseCredentials = true
+		}, expectedCleanup: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := CreateConfig()
+			config.LogLevel = None
+			test.configure(config)
+
+			handler, err := New(context.Background(), http.NotFoundHandler(), config, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			p := handler.(*AuthHackPlugin)
+			if (p.cleanup != nil) != test.expectedCleanup {
+				t.Fatalf("expected cleanup to be started: %v", test.expectedCleanup)
+			}
+
+			for i := 0; i < 2; i++ {
+				if err := p.Close(); err != nil {
+					t.Errorf("expected no error closing but found: %v", err)
+				}
+			}
+
+			if p.cleanup != nil {
+				select {
+				case <-p.cleanup.done:
+				default:
+					t.Errorf("expected the cleanup goroutine to have exited")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package traefik_authhack
+
+import (
+	"fmt"
+	"strings"
+)
+
+// hopByHopHeaders are the headers that only apply to a single connection, see RFC 9110 section 7.6.1.
+var hopByHopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection", "TE", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// maxRejectJitterMs bounds the reject jitter, since each delayed rejection holds on to the request until it's over.
+const maxRejectJitterMs = 1000
+
+// validateConfig checks for config values that would otherwise fail (or produce malformed headers) at runtime.
+func validateConfig(config *Config) error {
+	switch config.MissingPasswordPolicy {
+	case "", MissingPasswordAllow, MissingPasswordSkip:
+	default:
+		return fmt.Errorf("invalid MissingPasswordPolicy '%s'", config.MissingPasswordPolicy)
+	}
+
+	if config.RejectJitterMinMs < 0 || config.RejectJitterMaxMs < 0 || (config.RejectJitterMaxMs != 0 && config.RejectJitterMaxMs < config.RejectJitterMinMs) ||
+		config.RejectJitterMinMs > maxRejectJitterMs || config.RejectJitterMaxMs > maxRejectJitterMs {
+		return fmt.Errorf("invalid RejectJitterMinMs ('%v') / RejectJitterMaxMs ('%v')", config.RejectJitterMinMs, config.RejectJitterMaxMs)
+	}
+
+	if config.CredentialCharset != "" && !strings.EqualFold(config.CredentialCharset, CharsetUTF8) && !strings.EqualFold(config.CredentialCharset, CharsetISO88591) {
+		return fmt.Errorf("invalid CredentialCharset '%s'", config.CredentialCharset)
+	}
+
+	if config.NestedCredentialKey != "" && len(config.NestedCredentialSchemes) == 0 {
+		return fmt.Errorf("NestedCredentialSchemes must be set when NestedCredentialKey is set")
+	}
+
+	if config.AuthorizationFromHeaderKey && len(config.AllowedReferencedHeaders) == 0 {
+		return fmt.Errorf("AllowedReferencedHeaders must be set when AuthorizationFromHeaderKey is set")
+	}
+
+	if config.MinUsernameLength < 0 || config.MaxUsernameLength < 0 || (config.MaxUsernameLength != 0 && config.MaxUsernameLength < config.MinUsernameLength) {
+		return fmt.Errorf("invalid MinUsernameLength ('%v') / MaxUsernameLength ('%v')", config.MinUsernameLength, config.MaxUsernameLength)
+	}
+
+	if config.MaxPasswordLength < 0 {
+		return fmt.Errorf("invalid MaxPasswordLength '%v'", config.MaxPasswordLength)
+	}
+
+	if config.CleanupIntervalSeconds < 0 {
+		return fmt.Errorf("invalid CleanupIntervalSeconds '%v'", config.CleanupIntervalSeconds)
+	}
+
+	if config.DecisionHistorySize < 0 {
+		return fmt.Errorf("invalid DecisionHistorySize '%v'", config.DecisionHistorySize)
+	}
+
+	if config.DecisionHistorySize > 0 && config.DebugToken == "" {
+		return fmt.Errorf("DebugToken must be set when DecisionHistorySize is set")
+	}
+
+	if config.CookieSignatureMaxAgeSeconds < 0 {
+		return fmt.Errorf("invalid CookieSignatureMaxAgeSeconds '%v'", config.CookieSignatureMaxAgeSeconds)
+	}
+
+	if config.CookieSigningKey == "" && (config.CookieSignatureMaxAgeSeconds > 0 || config.ResignCookieOnUse) {
+		return fmt.Errorf("CookieSigningKey must be set when CookieSignatureMaxAgeSeconds or ResignCookieOnUse are set")
+	}
+
+	if config.SingleUseCredentials && (config.SingleUseCacheSize <= 0 || config.SingleUseTTLSeconds <= 0) {
+		return fmt.Errorf("invalid SingleUseCacheSize ('%v') / SingleUseTTLSeconds ('%v')", config.SingleUseCacheSize, config.SingleUseTTLSeconds)
+	}
+
+	if config.LogoutRequireToken && (config.CSRFHeaderName == "" || config.LogoutToken == "") {
+		return fmt.Errorf("CSRFHeaderName and LogoutToken must be set when LogoutRequireToken is set")
+	}
+
+	for path, override := range config.PathKeyOverrides {
+		if !strings.HasPrefix(path, "/") || override == nil {
+			return fmt.Errorf("invalid PathKeyOverrides entry '%s': must be a path starting with '/' with an override", path)
+		}
+	}
+
+	for _, prefix := range config.RedirectAllowedPrefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("invalid RedirectAllowedPrefixes entry '%s': must start with '/'", prefix)
+		}
+	}
+
+	if config.MaxConfigListEntries < 0 {
+		return fmt.Errorf("invalid MaxConfigListEntries '%v'", config.MaxConfigListEntries)
+	}
+
+	// Lists are scanned on every request, so bound them to keep pathological configs off the hot path
+	if config.MaxConfigListEntries > 0 {
+		for _, list := range []struct {
+			field   string
+			entries []string
+		}{
+			{field: "NestedCredentialSchemes", entries: config.NestedCredentialSchemes},
+			{field: "AllowedReferencedHeaders", entries: config.AllowedReferencedHeaders},
+			{field: "BearerMarkers", entries: config.BearerMarkers},
+			{field: "TrustedCIDRs", entries: config.TrustedCIDRs},
+			{field: "TrustedProxyCIDRs", entries: config.TrustedProxyCIDRs},
+			{field: "KnownSafeQueryParams", entries: config.KnownSafeQueryParams},
+			{field: "ChallengeSchemes", entries: config.ChallengeSchemes},
+			{field: "RedirectAllowedPrefixes", entries: config.RedirectAllowedPrefixes},
+			{field: "CredentialsKeys", entries: config.CredentialsKeys},
+		} {
+			if len(list.entries) > config.MaxConfigListEntries {
+				return fmt.Errorf("%s has %v entries, more than MaxConfigListEntries ('%v')", list.field, len(list.entries), config.MaxConfigListEntries)
+			}
+		}
+
+		if len(config.PathKeyOverrides) > config.MaxConfigListEntries {
+			return fmt.Errorf("PathKeyOverrides has %v entries, more than MaxConfigListEntries ('%v')", len(config.PathKeyOverrides), config.MaxConfigListEntries)
+		}
+	}
+
+	if config.HeaderName == "" {
+		return fmt.Errorf("HeaderName must be set")
+	}
+
+	// Hop-by-hop headers are removed by the reverse proxy, so the credentials would never reach the downstream service
+	if containsStringFold(hopByHopHeaders, config.HeaderName) {
+		return fmt.Errorf("invalid HeaderName '%s': hop-by-hop headers aren't forwarded", config.HeaderName)
+	}
+
+	for field, value := range map[string]string{
+		"HeaderName":                    config.HeaderName,
+		"CookieName":                    config.CookieName,
+		"CredentialQueryCookie":         config.CredentialQueryCookie,
+		"CSRFHeaderName":                config.CSRFHeaderName,
+		"DecisionResponseHeader":        config.DecisionResponseHeader,
+		"QueryCredentialsWarningHeader": config.QueryCredentialsWarningHeader,
+	} {
+		if value != "" && !isValidToken(value) {
+			return fmt.Errorf("invalid %s '%s': must only contain ASCII letters, digits and !#$%%&'*+-.^_`|~", field, value)
+		}
+	}
+
+	for _, scheme := range config.ChallengeSchemes {
+		if !isValidToken(scheme) {
+			return fmt.Errorf("invalid ChallengeSchemes entry '%s': must only contain ASCII letters, digits and !#$%%&'*+-.^_`|~", scheme)
+		}
+	}
+
+	return nil
+}
+
+// isValidToken returns whether the value is a valid token (RFC 7230, section 3.2.6), as required for header names,
+// cookie names and authentication schemes.
+func isValidToken(value string) bool {
+	if value == "" {
+		return false
+	}
+
+	for i := 0; i < len(value); i++ {
+		if !isTokenChar(value[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isTokenChar(c byte) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
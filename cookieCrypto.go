@@ -0,0 +1,179 @@
+package traefik_authhack
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errCookieDecryption = errors.New("cookie couldn't be decrypted with any configured key")
+	errCookieSignature  = errors.New("cookie signature is missing or invalid")
+	errCookieExpired    = errors.New("cookie signature has expired")
+)
+
+// cookieCipher encrypts the cookie value so that the credentials aren't readable from the browser's cookie store.
+// Values are always encrypted with the current key, but the previous key is still accepted when decrypting so that keys
+// can be rotated without invalidating every cookie at once.
+type cookieCipher struct {
+	current  cipher.AEAD
+	previous cipher.AEAD // nil if there's no previous key
+}
+
+// newCookieCipher creates a cipher from the configured keys, nil if encryption is disabled.
+func newCookieCipher(key, previousKey string) (*cookieCipher, error) {
+	if key == "" {
+		if previousKey != "" {
+			return nil, fmt.Errorf("CookieEncryptionKey must be set when CookieEncryptionKeyPrevious is set")
+		}
+
+		return nil, nil
+	}
+
+	current, err := newCookieAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &cookieCipher{current: current}
+
+	if previousKey != "" {
+		c.previous, err = newCookieAEAD(previousKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// newCookieAEAD creates an AES-256-GCM cipher using a key derived from the configured (arbitrary length) key.
+func newCookieAEAD(key string) (cipher.AEAD, error) {
+	derivedKey := sha256.Sum256([]byte(key))
+
+	block, err := aes.NewCipher(derivedKey[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Encrypt encrypts the value with the current key, returning a value safe to use in a cookie.
+func (c *cookieCipher) Encrypt(value string) (string, error) {
+	nonce := make([]byte, c.current.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := c.current.Seal(nonce, nonce, []byte(value), nil)
+
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts the value with the current key, falling back to the previous key. usedPrevious is true if the value
+// was encrypted with the previous key, in which case it should be re-issued with the current key.
+func (c *cookieCipher) Decrypt(value string) (plaintext string, usedPrevious bool, err error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return "", false, errCookieDecryption
+	}
+
+	if opened, err := openCookie(c.current, sealed); err == nil {
+		return opened, false, nil
+	}
+
+	if c.previous != nil {
+		if opened, err := openCookie(c.previous, sealed); err == nil {
+			return opened, true, nil
+		}
+	}
+
+	return "", false, errCookieDecryption
+}
+
+func openCookie(aead cipher.AEAD, sealed []byte) (string, error) {
+	nonceSize := aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", errCookieDecryption
+	}
+
+	opened, err := aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(opened), nil
+}
+
+// cookieSigner signs the cookie value along with the time it was signed, so that tampered or stale cookies are
+// rejected. Signed values are formatted as `<value>.<unix seconds>.<signature>`, the value may itself contain dots.
+type cookieSigner struct {
+	key    []byte
+	maxAge time.Duration // 0 if signatures don't expire
+	now    func() time.Time
+}
+
+// newCookieSigner creates a signer from the configured key, nil if signing is disabled.
+func newCookieSigner(key string, maxAge time.Duration) *cookieSigner {
+	if key == "" {
+		return nil
+	}
+
+	return &cookieSigner{key: []byte(key), maxAge: maxAge, now: time.Now}
+}
+
+// Sign signs the value with the current time.
+func (s *cookieSigner) Sign(value string) string {
+	signed := value + "." + strconv.FormatInt(s.now().Unix(), 10)
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(s.mac(signed))
+}
+
+// Verify returns the value if its signature is valid (compared in constant time) and hasn't expired.
+func (s *cookieSigner) Verify(signedValue string) (string, error) {
+	i := strings.LastIndexByte(signedValue, '.')
+	if i < 0 {
+		return "", errCookieSignature
+	}
+
+	signed, encodedSignature := signedValue[:i], signedValue[i+1:]
+
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil || !hmac.Equal(signature, s.mac(signed)) {
+		return "", errCookieSignature
+	}
+
+	j := strings.LastIndexByte(signed, '.')
+	if j < 0 {
+		return "", errCookieSignature
+	}
+
+	value, encodedTimestamp := signed[:j], signed[j+1:]
+
+	timestamp, err := strconv.ParseInt(encodedTimestamp, 10, 64)
+	if err != nil {
+		return "", errCookieSignature
+	}
+
+	if s.maxAge > 0 && s.now().Sub(time.Unix(timestamp, 0)) > s.maxAge {
+		return "", errCookieExpired
+	}
+
+	return value, nil
+}
+
+func (s *cookieSigner) mac(value string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(value))
+
+	return mac.Sum(nil)
+}
@@ -0,0 +1,84 @@
+package traefik_authhack
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestCookieCipher_RoundTrip(t *testing.T) {
+	c, err := newCookieCipher("current", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := c.Encrypt("value")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decrypted, usedPrevious, err := c.Decrypt(encrypted); err != nil || decrypted != "value" || usedPrevious {
+		t.Errorf("expected 'value' decrypted with the current key but found '%s' (%v, %v)", decrypted, usedPrevious, err)
+	}
+}
+
+func TestCookieCipher_Tampered(t *testing.T) {
+	c, err := newCookieCipher("current", "previous")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := c.Encrypt("value")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flipping any bit (in the nonce, ciphertext or tag) must fail without returning any plaintext
+	for i := range sealed {
+		tampered := append([]byte{}, sealed...)
+		tampered[i] ^= 0x01
+
+		if decrypted, _, err := c.Decrypt(base64.RawURLEncoding.EncodeToString(tampered)); err == nil || decrypted != "" {
+			t.Errorf("expected error decrypting value tampered at byte %v but found '%s' (%v)", i, decrypted, err)
+		}
+	}
+
+	for _, value := range []string{"", "c2hvcnQ", "not*base64"} {
+		if decrypted, _, err := c.Decrypt(value); err == nil || decrypted != "" {
+			t.Errorf("expected error decrypting '%s' but found '%s' (%v)", value, decrypted, err)
+		}
+	}
+}
+
+func TestCookieSigner_Verify(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	s := newCookieSigner("key", time.Minute)
+	s.now = func() time.Time { return now }
+
+	signed := s.Sign("a.b")
+
+	if value, err := s.Verify(signed); err != nil || value != "a.b" {
+		t.Errorf("expected 'a.b' but found '%s' (%v)", value, err)
+	}
+
+	other := newCookieSigner("other", time.Minute)
+	other.now = s.now
+
+	for _, value := range []string{"", "a.b", "a.b.1000", signed + "x", other.Sign("a.b"), "c" + signed[1:]} {
+		if verified, err := s.Verify(value); err == nil || verified != "" {
+			t.Errorf("expected error verifying '%s' but found '%s' (%v)", value, verified, err)
+		}
+	}
+
+	now = now.Add(time.Minute + time.Second)
+
+	if value, err := s.Verify(signed); err != errCookieExpired || value != "" {
+		t.Errorf("expected expired signature but found '%s' (%v)", value, err)
+	}
+}
@@ -0,0 +1,62 @@
+package traefik_authhack
+
+import (
+	"sync"
+	"time"
+)
+
+// decisionRecord describes what the plugin did with a request, credentials are redacted.
+type decisionRecord struct {
+	Time     time.Time `json:"time"`
+	Decision string    `json:"decision"`
+	Source   string    `json:"source,omitempty"`
+	Path     string    `json:"path"`
+	User     string    `json:"user,omitempty"`
+}
+
+// decisionHistory is a fixed size ring buffer of the most recent decisions, safe for concurrent use.
+type decisionHistory struct {
+	mutex   sync.Mutex
+	records []decisionRecord
+	next    int  // Index the next record is written to
+	full    bool // Whether the buffer has wrapped around
+}
+
+func newDecisionHistory(size int) *decisionHistory {
+	return &decisionHistory{records: make([]decisionRecord, size)}
+}
+
+// Add records the decision, overwriting the oldest one if the buffer is full.
+func (h *decisionHistory) Add(record decisionRecord) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.records[h.next] = record
+	h.next = (h.next + 1) % len(h.records)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Records returns a copy of the recorded decisions, oldest first.
+func (h *decisionHistory) Records() []decisionRecord {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if !h.full {
+		return append([]decisionRecord{}, h.records[:h.next]...)
+	}
+
+	return append(append([]decisionRecord{}, h.records[h.next:]...), h.records[:h.next]...)
+}
+
+// redactUsername keeps just enough of the username to tell users apart at a glance.
+func redactUsername(username string) string {
+	if username == "" {
+		return ""
+	}
+
+	runes := []rune(username)
+
+	return string(runes[0]) + "***"
+}
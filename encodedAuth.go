@@ -2,6 +2,9 @@ package traefik_authhack
 
 import (
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"strings"
 )
 
@@ -14,6 +17,40 @@ const emptyEncodedAuthWithoutPrefix = (encodedAuthWithoutPrefix)("")
 const emptyEncodedAuthWithPrefix = (encodedAuthWithPrefix)("")
 
 const basicPrefix = "Basic "
+const bearerPrefix = "Bearer "
+
+// CharsetUTF8 and CharsetISO88591 are the supported values of Config.CredentialCharset.
+const (
+	CharsetUTF8     = "utf-8"
+	CharsetISO88591 = "iso-8859-1"
+)
+
+// Errors returned by encodedAuthWithoutPrefix.Validate for malformed basic credentials (see RFC 7617).
+var (
+	errInvalidBase64 = errors.New("credentials aren't valid base64")
+	errMissingColon  = errors.New("decoded credentials don't contain a colon separating the username and password")
+	errMalformedJWT  = errors.New("bearer token isn't a well-formed JWT")
+)
+
+// canonicalAuthSchemes are the schemes normalizeAuthScheme knows the canonical casing of.
+var canonicalAuthSchemes = []string{"Basic", "Bearer", "Digest"}
+
+// normalizeAuthScheme returns the authorization header value with the casing of its scheme normalized (e.g.
+// "BASIC xyz" becomes "Basic xyz"). Unknown schemes are returned unchanged.
+func normalizeAuthScheme(value string) string {
+	scheme, credentials, found := strings.Cut(value, " ")
+	if !found {
+		return value
+	}
+
+	for _, canonicalScheme := range canonicalAuthSchemes {
+		if strings.EqualFold(scheme, canonicalScheme) {
+			return canonicalScheme + " " + credentials
+		}
+	}
+
+	return value
+}
 
 func newEncodedAuthWithoutPrefix(encodedAuth string) encodedAuthWithoutPrefix {
 	for t := strings.TrimPrefix(encodedAuth, basicPrefix); t != encodedAuth; t = strings.TrimPrefix(encodedAuth, basicPrefix) {
@@ -26,10 +63,100 @@ func encodeAuthWithoutPrefix(username, password string) encodedAuthWithoutPrefix
 	return (encodedAuthWithoutPrefix)(base64.StdEncoding.EncodeToString([]byte(username + ":" + password)))
 }
 
+// encodeAuthWithoutPrefixCharset is like encodeAuthWithoutPrefix but transcodes the credentials to the charset first
+// (see RFC 7617). Fails if the credentials can't be represented in the charset.
+func encodeAuthWithoutPrefixCharset(username, password, charset string) (encodedAuthWithoutPrefix, error) {
+	if !strings.EqualFold(charset, CharsetISO88591) {
+		return encodeAuthWithoutPrefix(username, password), nil
+	}
+
+	encoded, err := encodeLatin1(username + ":" + password)
+	if err != nil {
+		return emptyEncodedAuthWithoutPrefix, err
+	}
+
+	return (encodedAuthWithoutPrefix)(base64.StdEncoding.EncodeToString(encoded)), nil
+}
+
+// encodeLatin1 transcodes the (UTF-8) string to ISO-8859-1, whose code points match the first 256 of Unicode.
+func encodeLatin1(s string) ([]byte, error) {
+	encoded := make([]byte, 0, len(s))
+
+	for _, r := range s {
+		if r > 0xFF {
+			return nil, fmt.Errorf("character '%c' can't be represented in %s", r, CharsetISO88591)
+		}
+
+		encoded = append(encoded, byte(r))
+	}
+
+	return encoded, nil
+}
+
+// newBearerAuth creates auth for a bearer token. Unlike basic auth, the (bearer) prefix is kept with the token so
+// that it can be told apart from basic auth when stored in the cookie.
+func newBearerAuth(token string) encodedAuthWithoutPrefix {
+	return (encodedAuthWithoutPrefix)(bearerPrefix + token)
+}
+
 func (a encodedAuthWithoutPrefix) WithPrefix() encodedAuthWithPrefix {
+	if a.IsBearer() {
+		return (encodedAuthWithPrefix)(a)
+	}
+
 	return (encodedAuthWithPrefix)(basicPrefix + a)
 }
 
+// Validate checks that basic credentials decode to `username:password`, bearer tokens aren't checked.
+func (a encodedAuthWithoutPrefix) Validate() error {
+	if a.IsBearer() {
+		return nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(a.String())
+	if err != nil {
+		return errInvalidBase64
+	}
+
+	if !strings.Contains(string(decoded), ":") {
+		return errMissingColon
+	}
+
+	return nil
+}
+
+// ValidateJWTStructure checks that a bearer token is structurally a JWT: three base64url segments, with a JSON object
+// header and payload. The signature isn't verified. Basic credentials aren't checked.
+func (a encodedAuthWithoutPrefix) ValidateJWTStructure() error {
+	if !a.IsBearer() {
+		return nil
+	}
+
+	segments := strings.Split(strings.TrimPrefix(a.String(), bearerPrefix), ".")
+	if len(segments) != 3 {
+		return errMalformedJWT
+	}
+
+	for i, segment := range segments {
+		decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+		if err != nil {
+			return errMalformedJWT
+		}
+
+		// The signature is opaque, but the header and payload must be JSON objects
+		var object map[string]any
+		if i < 2 && json.Unmarshal(decoded, &object) != nil {
+			return errMalformedJWT
+		}
+	}
+
+	return nil
+}
+
+func (a encodedAuthWithoutPrefix) IsBearer() bool {
+	return strings.HasPrefix(a.String(), bearerPrefix)
+}
+
 func (a encodedAuthWithoutPrefix) String() string {
 	return (string)(a)
 }
@@ -38,6 +165,40 @@ func (a encodedAuthWithoutPrefix) IsEmpty() bool {
 	return a == ""
 }
 
+// Username decodes the username from the auth. An empty string is returned if the auth can't be decoded or is a
+// bearer token.
+func (a encodedAuthWithoutPrefix) Username() string {
+	if a.IsBearer() {
+		return ""
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(a.String())
+	if err != nil {
+		return ""
+	}
+
+	username, _, _ := strings.Cut(string(decoded), ":")
+
+	return username
+}
+
+// Password decodes the password from the auth. An empty string is returned if the auth can't be decoded or is a
+// bearer token.
+func (a encodedAuthWithoutPrefix) Password() string {
+	if a.IsBearer() {
+		return ""
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(a.String())
+	if err != nil {
+		return ""
+	}
+
+	_, password, _ := strings.Cut(string(decoded), ":")
+
+	return password
+}
+
 //goland:noinspection GoUnusedFunction
 func newEncodedAuthWithPrefix(encodedAuth string) encodedAuthWithPrefix {
 	return newEncodedAuthWithoutPrefix(encodedAuth).WithPrefix()
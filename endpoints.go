@@ -0,0 +1,145 @@
+package traefik_authhack
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Paths of the plugin's endpoints, relative to Config.BasePath.
+const (
+	healthEndpointPath    = "/health"
+	metricsEndpointPath   = "/metrics"
+	logoutEndpointPath    = "/logout"
+	decisionsEndpointPath = "/debug/decisions"
+)
+
+// DebugTokenHeader must be set to Config.DebugToken to access the debug endpoints.
+const DebugTokenHeader = "X-AuthHack-Debug-Token"
+
+// buildEndpoints maps the full path of each enabled endpoint to its handler.
+func (p *AuthHackPlugin) buildEndpoints() map[string]http.HandlerFunc {
+	endpoints := map[string]http.HandlerFunc{}
+
+	if p.config.HealthEndpoint {
+		endpoints[joinEndpointPath(p.config.BasePath, healthEndpointPath)] = p.serveHealth
+	}
+
+	if p.metrics != nil {
+		endpoints[joinEndpointPath(p.config.BasePath, metricsEndpointPath)] = p.serveMetrics
+	}
+
+	if p.config.LogoutEndpoint {
+		endpoints[joinEndpointPath(p.config.BasePath, logoutEndpointPath)] = p.serveLogout
+	}
+
+	if p.decisionHistory != nil {
+		endpoints[joinEndpointPath(p.config.BasePath, decisionsEndpointPath)] = p.requireDebugToken(p.serveDecisions)
+	}
+
+	return endpoints
+}
+
+func joinEndpointPath(basePath, endpointPath string) string {
+	basePath = strings.Trim(basePath, "/")
+	if basePath == "" {
+		return endpointPath
+	}
+
+	return "/" + basePath + endpointPath
+}
+
+func (p *AuthHackPlugin) serveHealth(responseWriter http.ResponseWriter, _ *http.Request) {
+	responseWriter.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	responseWriter.WriteHeader(http.StatusOK)
+
+	if _, err := responseWriter.Write([]byte("ok")); err != nil {
+		p.log(Warning, "encountered error sending health response: %v", err)
+	}
+}
+
+func (p *AuthHackPlugin) serveMetrics(responseWriter http.ResponseWriter, _ *http.Request) {
+	responseWriter.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	responseWriter.WriteHeader(http.StatusOK)
+
+	if _, err := p.metrics.WriteTo(responseWriter); err != nil {
+		p.log(Warning, "encountered error sending metrics response: %v", err)
+	}
+}
+
+// serveLogout clears the cookie. When LogoutRequireToken is enabled, the request must also provide the CSRF token so
+// that other sites can't force a logout.
+func (p *AuthHackPlugin) serveLogout(responseWriter http.ResponseWriter, request *http.Request) {
+	if p.config.LogoutRequireToken && !p.hasValidLogoutToken(request) {
+		p.log(Info, "rejecting logout request without a valid token")
+		http.Error(responseWriter, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+
+		return
+	}
+
+	p.log(Debug, "logging out, clearing cookie")
+
+	cookie := &http.Cookie{
+		Name:     p.config.CookieName,
+		Value:    "",
+		Domain:   p.config.CookieDomain,
+		Path:     p.config.CookiePath,
+		MaxAge:   -1, // Delete the cookie
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+
+	responseWriter.Header().Add("Set-Cookie", cookie.String())
+	responseWriter.Header().Set("Cache-Control", "no-store")
+	responseWriter.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	responseWriter.WriteHeader(http.StatusOK)
+
+	if _, err := responseWriter.Write([]byte("logged out")); err != nil {
+		p.log(Warning, "encountered error sending logout response: %v", err)
+	}
+}
+
+// hasValidLogoutToken returns whether the CSRF header matches the configured LogoutToken.
+func (p *AuthHackPlugin) hasValidLogoutToken(request *http.Request) bool {
+	token := request.Header.Get(p.config.CSRFHeaderName)
+	if token == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(p.config.LogoutToken)) == 1
+}
+
+// requireDebugToken only serves the endpoint if the request provides the debug token.
+func (p *AuthHackPlugin) requireDebugToken(endpoint http.HandlerFunc) http.HandlerFunc {
+	return func(responseWriter http.ResponseWriter, request *http.Request) {
+		token := request.Header.Get(DebugTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(p.config.DebugToken)) != 1 {
+			p.log(Info, "rejecting debug endpoint request ('%s') without a valid debug token", request.URL.Path)
+			http.Error(responseWriter, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+
+			return
+		}
+
+		endpoint(responseWriter, request)
+	}
+}
+
+func (p *AuthHackPlugin) serveDecisions(responseWriter http.ResponseWriter, _ *http.Request) {
+	body, err := json.Marshal(p.decisionHistory.Records())
+	if err != nil {
+		p.log(Error, "encountered error encoding decisions: %v", err)
+		http.Error(responseWriter, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+
+		return
+	}
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.Header().Set("Cache-Control", "no-store")
+	responseWriter.WriteHeader(http.StatusOK)
+
+	if _, err := responseWriter.Write(body); err != nil {
+		p.log(Warning, "encountered error sending decisions response: %v", err)
+	}
+}
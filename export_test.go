@@ -0,0 +1,13 @@
+package traefik_authhack
+
+import "io"
+
+// SetLogWriter sets the writer that logs are written to, returning a function that restores the previous writer.
+func SetLogWriter(w io.Writer) (restore func()) {
+	previous := logWriter
+	logWriter = w
+
+	return func() {
+		logWriter = previous
+	}
+}
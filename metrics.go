@@ -0,0 +1,69 @@
+package traefik_authhack
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// metricsSources and metricsDecisions are the label values of the metrics, fixed so that the counters don't need a lock.
+var (
+	metricsSources   = []string{sourceQuery, sourceCookie}
+	metricsDecisions = []string{decisionNoop, decisionRedirected, strings.TrimSuffix(decisionApplied, ":"), decisionRejected}
+)
+
+// metrics counts what the plugin does with requests, safe for concurrent use.
+type metrics struct {
+	extractions map[string]*uint64 // By source
+	decisions   map[string]*uint64 // By decision
+}
+
+func newMetrics() *metrics {
+	m := &metrics{extractions: map[string]*uint64{}, decisions: map[string]*uint64{}}
+
+	for _, source := range metricsSources {
+		m.extractions[source] = new(uint64)
+	}
+
+	for _, decision := range metricsDecisions {
+		m.decisions[decision] = new(uint64)
+	}
+
+	return m
+}
+
+// Record counts the decision and, if credentials were used, their source.
+func (m *metrics) Record(decision, source string) {
+	// Applied decisions include the source, which is already a label of the extractions
+	decision, _, _ = strings.Cut(decision, ":")
+
+	if counter, ok := m.decisions[decision]; ok {
+		atomic.AddUint64(counter, 1)
+	}
+
+	if counter, ok := m.extractions[source]; ok {
+		atomic.AddUint64(counter, 1)
+	}
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (m *metrics) WriteTo(w io.Writer) (int64, error) {
+	var builder strings.Builder
+
+	builder.WriteString("# HELP authhack_extractions_total Number of requests whose credentials were extracted, by source.\n")
+	builder.WriteString("# TYPE authhack_extractions_total counter\n")
+	for _, source := range metricsSources {
+		_, _ = fmt.Fprintf(&builder, "authhack_extractions_total{source=%q} %d\n", source, atomic.LoadUint64(m.extractions[source]))
+	}
+
+	builder.WriteString("# HELP authhack_decisions_total Number of requests handled, by decision.\n")
+	builder.WriteString("# TYPE authhack_decisions_total counter\n")
+	for _, decision := range metricsDecisions {
+		_, _ = fmt.Fprintf(&builder, "authhack_decisions_total{decision=%q} %d\n", decision, atomic.LoadUint64(m.decisions[decision]))
+	}
+
+	n, err := io.WriteString(w, builder.String())
+
+	return int64(n), err
+}
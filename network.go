@@ -0,0 +1,66 @@
+package traefik_authhack
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const forwardedForHeader = "X-Forwarded-For"
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR '%s': %w", cidr, err)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// getClientIP returns the IP of the client that sent the request. Starting with the remote address, the X-Forwarded-For
+// entries are walked from the right for as long as they were added by a trusted proxy, since any entry to the left of
+// that may have been sent by the client. Without trusted proxies, this is just the remote address. Returns nil if the
+// IP can't be determined.
+func getClientIP(request *http.Request, trustedProxies []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+
+	var forwardedFor []string
+	for _, value := range request.Header.Values(forwardedForHeader) {
+		forwardedFor = append(forwardedFor, strings.Split(value, ",")...)
+	}
+
+	for i := len(forwardedFor) - 1; i >= 0 && containsIP(trustedProxies, ip); i-- {
+		// An entry that can't be parsed can't be attributed to anyone
+		if ip = net.ParseIP(strings.TrimSpace(forwardedFor[i])); ip == nil {
+			return nil
+		}
+	}
+
+	return ip
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
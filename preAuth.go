@@ -0,0 +1,94 @@
+package traefik_authhack
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Bounds how much of the pre-auth response body is drained (so that the connection can be reused).
+const maxPreAuthResponseBodySize = 64 * 1024
+
+func newPreAuthClient(config *Config) (*http.Client, error) {
+	if config.PreAuthURL == "" {
+		return nil, nil
+	}
+
+	preAuthURL, err := url.Parse(config.PreAuthURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PreAuthURL '%s': %w", config.PreAuthURL, err)
+	}
+
+	if preAuthURL.Scheme != "http" && preAuthURL.Scheme != "https" {
+		return nil, fmt.Errorf("invalid PreAuthURL '%s': scheme must be http or https", config.PreAuthURL)
+	}
+
+	if config.PreAuthTimeoutMs <= 0 {
+		return nil, fmt.Errorf("invalid PreAuthTimeoutMs '%v'", config.PreAuthTimeoutMs)
+	}
+
+	return &http.Client{
+		// Its own transport, so that closing the plugin only closes its own connections
+		Transport: http.DefaultTransport.(*http.Transport).Clone(),
+		Timeout:   time.Duration(config.PreAuthTimeoutMs) * time.Millisecond,
+		// Redirects aren't followed, they're treated as a failure like any other non-2xx response
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}, nil
+}
+
+// checkPreAuth sends the request's credentials to the pre-auth URL (if configured), rejecting the request unless the
+// pre-auth URL responds with a 2xx status code. Returns whether the request should continue to be proxied.
+func (p *AuthHackPlugin) checkPreAuth(responseWriter *responseHeaderWrapper, request *http.Request) bool {
+	if p.preAuthClient == nil {
+		return true
+	}
+
+	preAuthRequest, err := http.NewRequestWithContext(request.Context(), http.MethodGet, p.config.PreAuthURL, nil)
+	if err != nil {
+		p.log(Error, "encountered error creating pre-auth request: %v", err)
+		p.reject(responseWriter, request, http.StatusForbidden, "unable to create pre-auth request")
+
+		return false
+	}
+
+	if authorization := request.Header.Get(p.config.HeaderName); authorization != "" {
+		preAuthRequest.Header.Set(p.config.HeaderName, authorization)
+	}
+	preAuthRequest.Header.Set("X-Forwarded-Method", request.Method)
+	preAuthRequest.Header.Set("X-Forwarded-Uri", request.URL.RequestURI())
+
+	preAuthResponse, err := p.preAuthClient.Do(preAuthRequest)
+	if err != nil {
+		p.log(Warning, "encountered error sending pre-auth request: %v", err)
+		p.reject(responseWriter, request, http.StatusForbidden, "pre-auth request failed")
+
+		return false
+	}
+
+	defer func() { _ = preAuthResponse.Body.Close() }()
+
+	_, _ = io.Copy(io.Discard, io.LimitReader(preAuthResponse.Body, maxPreAuthResponseBodySize))
+
+	if preAuthResponse.StatusCode >= 200 && preAuthResponse.StatusCode < 300 {
+		p.log(Debug, "pre-auth succeeded with status code '%v'", preAuthResponse.StatusCode)
+
+		return true
+	}
+
+	if preAuthResponse.StatusCode == http.StatusUnauthorized {
+		// Pass the challenge along so that the client knows how to authenticate
+		for _, challenge := range preAuthResponse.Header.Values("WWW-Authenticate") {
+			responseWriter.Header().Add("WWW-Authenticate", challenge)
+		}
+
+		p.reject(responseWriter, request, http.StatusUnauthorized, "pre-auth failed with status code '%v'", preAuthResponse.StatusCode)
+	} else {
+		p.reject(responseWriter, request, http.StatusForbidden, "pre-auth failed with status code '%v'", preAuthResponse.StatusCode)
+	}
+
+	return false
+}
@@ -3,6 +3,7 @@ package traefik_authhack
 import (
 	"net/http"
 	"net/url"
+	"strings"
 )
 
 type requestQueryWrapper struct {
@@ -10,6 +11,13 @@ type requestQueryWrapper struct {
 
 	query      *url.Values
 	queryDirty bool
+
+	// The params deleted from the query, as long as nothing was set or added it can be applied by just removing these
+	deletedKeys map[string]bool
+	queryEdited bool
+
+	// The query parsed with '+' interpreted literally rather than as a space
+	literalPlusQuery *url.Values
 }
 
 func newQueryWrapper(request *http.Request) *requestQueryWrapper {
@@ -20,37 +28,97 @@ func (w *requestQueryWrapper) Get(key string) string {
 	return w.getQuery().Get(key)
 }
 
+// GetLiteralPlus gets the value of the query param, interpreting '+' literally rather than as a space.
+func (w *requestQueryWrapper) GetLiteralPlus(key string) string {
+	if w.literalPlusQuery == nil {
+		query, _ := url.ParseQuery(strings.ReplaceAll(w.request.URL.RawQuery, "+", "%2B"))
+		w.literalPlusQuery = &query
+	}
+
+	return w.literalPlusQuery.Get(key)
+}
+
 func (w *requestQueryWrapper) Set(key, value string) {
 	w.getQuery().Set(key, value)
 	w.queryDirty = true
+	w.queryEdited = true
 }
 
 func (w *requestQueryWrapper) Add(key, value string) {
 	w.getQuery().Add(key, value)
 	w.queryDirty = true
+	w.queryEdited = true
 }
 
 func (w *requestQueryWrapper) Del(key string) {
 	w.getQuery().Del(key)
 	w.queryDirty = true
+
+	if w.deletedKeys == nil {
+		w.deletedKeys = map[string]bool{}
+	}
+	w.deletedKeys[key] = true
+
+	if w.literalPlusQuery != nil {
+		w.literalPlusQuery.Del(key)
+	}
 }
 
 func (w *requestQueryWrapper) Has(key string) bool {
 	return w.getQuery().Has(key)
 }
 
+// Keys returns the names of the query params, in no particular order.
+func (w *requestQueryWrapper) Keys() []string {
+	keys := make([]string, 0, len(*w.getQuery()))
+	for key := range *w.getQuery() {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
 func (w *requestQueryWrapper) Apply() *http.Request {
 	if w.queryDirty {
-		w.request.URL.RawQuery = w.query.Encode()
+		if w.queryEdited {
+			w.request.URL.RawQuery = w.query.Encode()
+		} else {
+			// Re-encoding would sort the params and normalize their escaping, so only remove the deleted ones
+			w.request.URL.RawQuery = removeRawQueryParams(w.request.URL.RawQuery, w.deletedKeys)
+		}
 		w.request.RequestURI = w.request.URL.String()
 
 		w.query = nil
 		w.queryDirty = false
+		w.deletedKeys = nil
+		w.queryEdited = false
+		w.literalPlusQuery = nil
 	}
 
 	return w.request
 }
 
+// removeRawQueryParams removes the params with the (decoded) keys from the raw query, leaving the other params exactly
+// as they were.
+func removeRawQueryParams(rawQuery string, keys map[string]bool) string {
+	var kept []string
+
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+
+		rawKey, _, _ := strings.Cut(param, "=")
+		if key, err := url.QueryUnescape(rawKey); err == nil && keys[key] {
+			continue
+		}
+
+		kept = append(kept, param)
+	}
+
+	return strings.Join(kept, "&")
+}
+
 func (w *requestQueryWrapper) getQuery() *url.Values {
 	if w.query != nil {
 		return w.query
@@ -0,0 +1,77 @@
+package traefik_authhack
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// responseHeaderWrapper wraps a response to add headers just before they're written so that they take precedence over
+// any headers set by the downstream handler.
+type responseHeaderWrapper struct {
+	http.ResponseWriter
+
+	headers http.Header
+	applied bool
+}
+
+func newResponseHeaderWrapper(responseWriter http.ResponseWriter) *responseHeaderWrapper {
+	return &responseHeaderWrapper{ResponseWriter: responseWriter}
+}
+
+// Set sets a header that will be added to the response when it's written.
+func (w *responseHeaderWrapper) Set(key, value string) {
+	if w.headers == nil {
+		w.headers = http.Header{}
+	}
+
+	w.headers.Set(key, value)
+}
+
+func (w *responseHeaderWrapper) WriteHeader(statusCode int) {
+	w.Apply()
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *responseHeaderWrapper) Write(b []byte) (int, error) {
+	w.Apply()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseHeaderWrapper) Flush() {
+	w.Apply()
+
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *responseHeaderWrapper) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T doesn't support hijacking", w.ResponseWriter)
+	}
+
+	return hijacker.Hijack()
+}
+
+// Unwrap returns the wrapped response, used by http.ResponseController.
+func (w *responseHeaderWrapper) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Apply adds the pending headers to the wrapped response. This happens at most once, either before the response is
+// first written or, if the handler never writes the response, once the handler returns.
+func (w *responseHeaderWrapper) Apply() {
+	if w.applied {
+		return
+	}
+
+	header := w.ResponseWriter.Header()
+	for key, values := range w.headers {
+		header[key] = values
+	}
+
+	w.applied = true
+}
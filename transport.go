@@ -0,0 +1,133 @@
+package traefik_authhack
+
+import (
+	"context"
+	"net/http"
+)
+
+// transport applies the plugin's credential handling to outgoing requests.
+type transport struct {
+	base   http.RoundTripper
+	plugin *AuthHackPlugin
+	err    error // Set if the config is invalid, returned by every request
+}
+
+// NewTransport wraps the base transport (http.DefaultTransport if nil) so that credentials in the query params (or the
+// cookie) of outgoing requests are moved to the authorization header, like the plugin does for incoming requests.
+// Requests are sent with the credentials applied rather than being redirected. The transport implements io.Closer,
+// which releases the plugin's resources (but not the base transport's).
+func NewTransport(base http.RoundTripper, config *Config) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	plugin, err := newPlugin(config, "transport")
+
+	return &transport{base: base, plugin: plugin, err: err}
+}
+
+func (t *transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+
+	authorizedRequest, err := t.plugin.buildAuthorizedRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.base.RoundTrip(authorizedRequest)
+}
+
+func (t *transport) Close() error {
+	if t.plugin == nil {
+		return nil
+	}
+
+	return t.plugin.Close()
+}
+
+// RequestBuilder applies the plugin's credential handling to single requests, see NewRequestBuilder.
+type RequestBuilder struct {
+	plugin *AuthHackPlugin
+}
+
+// NewRequestBuilder creates a builder for authorized requests from the config. The config is only parsed once, so the
+// builder should be reused rather than created per request. Close releases the builder's resources.
+func NewRequestBuilder(config *Config) (*RequestBuilder, error) {
+	plugin, err := newPlugin(config, "request")
+	if err != nil {
+		return nil, err
+	}
+
+	return &RequestBuilder{plugin: plugin}, nil
+}
+
+// Build returns a copy of the request with the credentials from its query params (or the cookie) moved to the
+// authorization header, and the credentials removed from the URL. The request isn't modified. Returns an error if the
+// credentials fail a check that would reject the request in the middleware (see StrictCredentials).
+func (b *RequestBuilder) Build(request *http.Request) (*http.Request, error) {
+	return b.plugin.buildAuthorizedRequest(request)
+}
+
+func (b *RequestBuilder) Close() error {
+	return b.plugin.Close()
+}
+
+// newPlugin creates the plugin for use outside of Traefik, without a next handler.
+func newPlugin(config *Config, name string) (*AuthHackPlugin, error) {
+	handler, err := New(context.Background(), nil, config, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler.(*AuthHackPlugin), nil
+}
+
+func (p *AuthHackPlugin) buildAuthorizedRequest(request *http.Request) (*http.Request, error) {
+	authorizedRequest := request.Clone(request.Context())
+
+	hasAuthHeader := p.hasAuthHeader(authorizedRequest)
+
+	queryParamsAuth := p.getAndScrubAuthQueryParams(authorizedRequest)
+	// Cookie errors are already logged, and the cookie is treated as absent
+	cookieAuth, _, _ := p.getAndScrubAuthCookie(authorizedRequest)
+	if credentialCookieAuth := p.getAndScrubCredentialQueryCookie(authorizedRequest); cookieAuth.IsEmpty() {
+		cookieAuth = credentialCookieAuth
+	}
+
+	if p.config.ScrubForwardedURI {
+		p.scrubForwardedURIHeaders(authorizedRequest)
+	}
+
+	p.moveCSRFQueryParam(authorizedRequest)
+
+	// Scrubbing updates the RequestURI for the next handler, but it can't be set on client requests
+	authorizedRequest.RequestURI = request.RequestURI
+
+	if hasAuthHeader {
+		p.log(Debug, "found authorization header, sending request")
+
+		return authorizedRequest, nil
+	}
+
+	if !queryParamsAuth.IsEmpty() {
+		var err error
+		if queryParamsAuth, err = p.checkQueryCredentials(queryParamsAuth); err != nil {
+			return nil, err
+		}
+	}
+
+	auth := queryParamsAuth
+	if auth.IsEmpty() {
+		auth = cookieAuth
+	}
+
+	if !auth.IsEmpty() {
+		p.log(Debug, "moving auth to header and sending request")
+
+		authorizedRequest.Header.Set(p.config.HeaderName, auth.WithPrefix().String())
+	}
+
+	return authorizedRequest, nil
+}
@@ -0,0 +1,105 @@
+package traefik_authhack
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// ttlCache is a bounded, concurrency-safe, in-memory cache whose entries expire after a TTL. Once it's full, the least
+// recently set entries are evicted.
+type ttlCache struct {
+	mutex sync.Mutex
+
+	capacity int
+	ttl      time.Duration
+	now      func() time.Time
+
+	entries map[string]*list.Element
+	order   *list.List // Most recently set at the front
+}
+
+type ttlCacheEntry struct {
+	key     string
+	value   string
+	expires time.Time
+}
+
+func newTTLCache(capacity int, ttl time.Duration) *ttlCache {
+	return &ttlCache{
+		capacity: capacity,
+		ttl:      ttl,
+		now:      time.Now,
+		entries:  make(map[string]*list.Element, capacity),
+		order:    list.New(),
+	}
+}
+
+// Add sets the entry only if the key isn't already cached (or has expired), returning whether it was set.
+func (c *ttlCache) Add(key, value string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[key]; ok && c.now().Before(element.Value.(*ttlCacheEntry).expires) {
+		return false
+	}
+
+	c.set(key, value)
+
+	return true
+}
+
+func (c *ttlCache) set(key, value string) {
+	expires := c.now().Add(c.ttl)
+
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*ttlCacheEntry)
+		entry.value = value
+		entry.expires = expires
+
+		c.order.MoveToFront(element)
+
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&ttlCacheEntry{key: key, value: value, expires: expires})
+
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *ttlCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.order.Len()
+}
+
+// EvictExpired removes all expired entries, returning how many were removed. Expired entries are otherwise only removed
+// when they're added again or pushed out by newer entries.
+func (c *ttlCache) EvictExpired() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.now()
+	evicted := 0
+
+	for element := c.order.Back(); element != nil; {
+		previous := element.Prev()
+
+		if !now.Before(element.Value.(*ttlCacheEntry).expires) {
+			c.remove(element)
+			evicted++
+		}
+
+		element = previous
+	}
+
+	return evicted
+}
+
+func (c *ttlCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*ttlCacheEntry).key)
+}
@@ -0,0 +1,75 @@
+package traefik_authhack
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLCache_Add(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	cache := newTTLCache(2, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	if !cache.Add("a", "1") {
+		t.Errorf("expected 'a' to be added")
+	}
+
+	if cache.Add("a", "2") {
+		t.Errorf("expected 'a' not to be added again")
+	}
+
+	now = now.Add(time.Minute)
+
+	if !cache.Add("a", "3") {
+		t.Errorf("expected expired 'a' to be added again")
+	}
+}
+
+func TestTTLCache_EvictsOldest(t *testing.T) {
+	cache := newTTLCache(2, time.Minute)
+
+	cache.Add("a", "1")
+	cache.Add("b", "2")
+	cache.Add("c", "3")
+
+	if length := cache.Len(); length != 2 {
+		t.Errorf("expected cache to be bounded to 2 entries but found %v", length)
+	}
+
+	if !cache.Add("a", "1") {
+		t.Errorf("expected 'a' to be evicted")
+	}
+
+	if cache.Add("c", "3") {
+		t.Errorf("expected 'c' to be cached")
+	}
+}
+
+func TestTTLCache_EvictExpired(t *testing.T) {
+	now := time.Now()
+
+	cache := newTTLCache(3, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	cache.Add("a", "1")
+	cache.Add("b", "2")
+
+	now = now.Add(30 * time.Second)
+
+	cache.Add("c", "3")
+
+	now = now.Add(30 * time.Second)
+
+	if evicted := cache.EvictExpired(); evicted != 2 {
+		t.Errorf("expected 2 expired entries to be evicted but found %v", evicted)
+	}
+
+	if length := cache.Len(); length != 1 {
+		t.Errorf("expected 1 entry to remain but found %v", length)
+	}
+
+	if cache.Add("c", "3") {
+		t.Errorf("expected 'c' to be cached")
+	}
+}